@@ -0,0 +1,57 @@
+package mirage
+
+import "sync"
+
+var (
+	// number of events that may be queued for a subscriber before it is considered too slow and dropped
+	subscriberBuffer = 1000
+)
+
+// broker fans events out to live subscribers. Publishing never blocks on a subscriber, a subscriber
+// that falls too far behind has its channel closed instead.
+type broker[T any] struct {
+	mu   sync.Mutex
+	subs map[chan T]struct{}
+}
+
+func newBroker[T any]() *broker[T] {
+	return &broker[T]{
+		subs: map[chan T]struct{}{},
+	}
+}
+
+func (b *broker[T]) subscribe() chan T {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan T, subscriberBuffer)
+	b.subs[ch] = struct{}{}
+
+	return ch
+}
+
+// unsubscribe removes a subscriber. It is safe to call for a subscriber that has already been
+// dropped.
+func (b *broker[T]) unsubscribe(ch chan T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+func (b *broker[T]) publish(v T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- v:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
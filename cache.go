@@ -0,0 +1,235 @@
+package mirage
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	headPrefix = "head/"
+
+	docCacheKind     = "doc"
+	dataCacheKind    = "data"
+	serviceCacheKind = "service"
+	renderedKinds    = []string{docCacheKind, dataCacheKind, serviceCacheKind}
+
+	// rendered responses and head pointers expire so that dids which aren't being requested don't
+	// stay in redis forever
+	renderedCacheTTL = 24 * time.Hour
+
+	// hit and miss counts for each kind of rendered response, served at /debug/vars
+	cacheMetrics = expvar.NewMap("mirage_cache")
+
+	defaultLocalCacheSize = 100_000
+	defaultLocalCacheTTL  = 1 * time.Minute
+
+	// replicas drop their local cache entries for a did when a message is published here
+	invalidateChannel = redisPrefix + "invalidate"
+)
+
+// localInvalidation is published on invalidateChannel whenever the exporter changes a did's head
+type localInvalidation struct {
+	Did     string   `json:"did"`
+	Handles []string `json:"handles"`
+}
+
+// newLocalCache creates the in-process cache that sits in front of redis. A negative size disables
+// it, and zero values fall back to the defaults.
+func newLocalCache(size int, ttl time.Duration) *expirable.LRU[string, any] {
+	if size < 0 {
+		return nil
+	}
+
+	if size == 0 {
+		size = defaultLocalCacheSize
+	}
+
+	if ttl == 0 {
+		ttl = defaultLocalCacheTTL
+	}
+
+	return expirable.NewLRU[string, any](size, nil, ttl)
+}
+
+// localGet returns a value from the in-process cache. The keys are the same as the redis keys,
+// without the prefix.
+func localGet[T any](m *Mirage, key string) (T, bool) {
+	var v T
+	if m.local == nil {
+		return v, false
+	}
+
+	cached, ok := m.local.Get(key)
+	if !ok {
+		return v, false
+	}
+
+	v, ok = cached.(T)
+	return v, ok
+}
+
+func (m *Mirage) localAdd(key string, v any) {
+	if m.local != nil {
+		m.local.Add(key, v)
+	}
+}
+
+// invalidateLocal drops everything that the in-process cache holds for a did and its handles, and
+// tells the other replicas to do the same
+func (m *Mirage) invalidateLocal(did string, handles []string) {
+	m.dropLocal(did, handles)
+
+	b, err := json.Marshal(&localInvalidation{
+		Did:     did,
+		Handles: handles,
+	})
+	if err != nil {
+		return
+	}
+
+	if err := m.r.Publish(invalidateChannel, b).Err(); err != nil {
+		m.logger.Error("failed to publish invalidation", "did", did, "err", err)
+	}
+}
+
+func (m *Mirage) dropLocal(did string, handles []string) {
+	if m.local == nil {
+		return
+	}
+
+	m.local.Remove(didHandlePrefix + did)
+	for _, kind := range renderedKinds {
+		m.local.Remove(kind + "/" + did)
+	}
+
+	for _, handle := range handles {
+		m.local.Remove(handleDidPrefix + handle)
+	}
+}
+
+// runLocalInvalidation drops local cache entries as other replicas publish invalidations. It runs
+// until the context passed to NewMirage is cancelled.
+func (m *Mirage) runLocalInvalidation() {
+	if m.local == nil {
+		return
+	}
+
+	ps := m.r.Subscribe(invalidateChannel)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer ps.Close()
+
+		ch := ps.Channel()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+
+				var inv localInvalidation
+				if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+					m.logger.Error("failed to unmarshal invalidation", "err", err)
+					continue
+				}
+
+				m.dropLocal(inv.Did, inv.Handles)
+			}
+		}
+	}()
+}
+
+// handleCacheMetrics serves the cache metrics in the same shape as expvar's handler. The expvar
+// handler itself isn't used since it also publishes the command line, which includes credentials.
+func (m *Mirage) handleCacheMetrics(e echo.Context) error {
+	return e.JSONBlob(http.StatusOK, []byte(`{"mirage_cache": `+cacheMetrics.String()+`}`))
+}
+
+type cachedService struct {
+	Endpoint string `json:"endpoint"`
+	Found    bool   `json:"found"`
+}
+
+func renderedKey(kind, did, cid string) string {
+	return redisPrefix + kind + "/" + did + "/" + cid
+}
+
+// cachedRender returns a response rendered from the did's current head. Responses are cached in
+// redis under the did and the cid of the head that they were rendered from, and redis also keeps a
+// pointer to each did's head cid, so a hit doesn't touch postgres at all. The exporter moves the
+// head pointer when a new operation lands, which leaves responses for the old head unreachable.
+// The in-process cache sits in front of redis and is invalidated by the exporter.
+func cachedRender[T any](m *Mirage, kind, did string, render func(*PlcEntry) (T, error)) (T, error) {
+	localKey := kind + "/" + did
+	if v, ok := localGet[T](m, localKey); ok {
+		cacheMetrics.Add(kind+"_local_hits", 1)
+		return v, nil
+	}
+
+	var v T
+
+	head, err := m.r.Get(redisPrefix + headPrefix + did).Result()
+	if err == nil {
+		b, err := m.r.Get(renderedKey(kind, did, head)).Bytes()
+		if err == nil {
+			if err := json.Unmarshal(b, &v); err == nil {
+				cacheMetrics.Add(kind+"_hits", 1)
+				m.localAdd(localKey, v)
+				return v, nil
+			}
+		} else if err != redis.Nil {
+			m.logger.Error("failed to get rendered response", "kind", kind, "did", did, "err", err)
+		}
+	} else if err != redis.Nil {
+		m.logger.Error("failed to get head", "did", did, "err", err)
+	}
+
+	cacheMetrics.Add(kind+"_misses", 1)
+
+	entry, err := m.GetLastOp(did)
+	if err != nil {
+		return v, err
+	}
+
+	v, err = render(entry)
+	if err != nil {
+		return v, err
+	}
+
+	// the exporter sets the head unconditionally, so this never overwrites a newer head with the one
+	// that was just read from postgres
+	m.r.SetNX(redisPrefix+headPrefix+did, entry.Cid, renderedCacheTTL)
+
+	if b, err := json.Marshal(v); err == nil {
+		m.r.Set(renderedKey(kind, did, entry.Cid), b, renderedCacheTTL)
+	}
+
+	m.localAdd(localKey, v)
+
+	return v, nil
+}
+
+// setCachedHead points a did's cached responses at a new head, dropping the responses that were
+// rendered from the previous head
+func (m *Mirage) setCachedHead(did, cid string) {
+	prev, err := m.r.Get(redisPrefix + headPrefix + did).Result()
+	if err == nil && prev != cid {
+		keys := make([]string, 0, len(renderedKinds))
+		for _, kind := range renderedKinds {
+			keys = append(keys, renderedKey(kind, did, prev))
+		}
+		m.r.Del(keys...)
+	}
+
+	m.r.Set(redisPrefix+headPrefix+did, cid, renderedCacheTTL)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/haileyok/mirage"
+	"github.com/urfave/cli/v2"
+)
+
+func main() {
+	app := &cli.App{
+		Name:  "mirage",
+		Usage: "a plc directory mirror",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "postgres-host",
+				EnvVars: []string{"POSTGRES_HOST"},
+				Value:   "localhost",
+			},
+			&cli.StringFlag{
+				Name:    "postgres-port",
+				EnvVars: []string{"POSTGRES_PORT"},
+				Value:   "5432",
+			},
+			&cli.StringFlag{
+				Name:    "postgres-db",
+				EnvVars: []string{"POSTGRES_DB"},
+				Value:   "mirage",
+			},
+			&cli.StringFlag{
+				Name:    "postgres-user",
+				EnvVars: []string{"POSTGRES_USER"},
+				Value:   "postgres",
+			},
+			&cli.StringFlag{
+				Name:    "postgres-pass",
+				EnvVars: []string{"POSTGRES_PASS"},
+			},
+			&cli.StringFlag{
+				Name:    "redis-host",
+				EnvVars: []string{"REDIS_HOST"},
+				Value:   "localhost:6379",
+			},
+			&cli.StringFlag{
+				Name:    "log-level",
+				EnvVars: []string{"LOG_LEVEL"},
+				Value:   "info",
+			},
+			&cli.StringFlag{
+				Name:    "upstream",
+				Usage:   "plc directory root, /export url, or path to a jsonl export file or directory of export pages",
+				EnvVars: []string{"UPSTREAM"},
+				Value:   "https://plc.directory",
+			},
+			&cli.DurationFlag{
+				Name:    "poll-interval",
+				Usage:   "wait between export pages once ingestion has caught up",
+				EnvVars: []string{"POLL_INTERVAL"},
+				Value:   time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "catch-up-interval",
+				Usage:   "wait between export pages while ingestion is more than an hour behind",
+				EnvVars: []string{"CATCH_UP_INTERVAL"},
+				Value:   600 * time.Millisecond,
+			},
+			&cli.IntFlag{
+				Name:    "page-size",
+				Usage:   "number of entries requested per export page, at most 1000",
+				EnvVars: []string{"PAGE_SIZE"},
+				Value:   1000,
+			},
+			&cli.IntFlag{
+				Name:    "local-cache-size",
+				Usage:   "number of entries kept in the in-process cache, or -1 to disable it",
+				EnvVars: []string{"LOCAL_CACHE_SIZE"},
+				Value:   100_000,
+			},
+			&cli.DurationFlag{
+				Name:    "local-cache-ttl",
+				Usage:   "how long entries are kept in the in-process cache",
+				EnvVars: []string{"LOCAL_CACHE_TTL"},
+				Value:   time.Minute,
+			},
+			&cli.BoolFlag{
+				Name:    "verify-handles",
+				Usage:   "verify handles in the background as the exporter changes them",
+				EnvVars: []string{"VERIFY_HANDLES"},
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "serve",
+				Usage: "run the web server along with the exporter",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "server-port",
+						EnvVars: []string{"SERVER_PORT"},
+						Value:   "5072",
+					},
+					&cli.StringFlag{
+						Name:    "admin-token",
+						Usage:   "bearer token for the /admin api, which is disabled if this is not set",
+						EnvVars: []string{"ADMIN_TOKEN"},
+					},
+				},
+				Action: func(cmd *cli.Context) error {
+					m, err := newMirage(cmd)
+					if err != nil {
+						return err
+					}
+
+					m.RunServer(&mirage.MirageServerArgs{
+						ServerPort: cmd.String("server-port"),
+						AdminToken: cmd.String("admin-token"),
+					})
+
+					return nil
+				},
+			},
+			{
+				Name:  "ingest",
+				Usage: "run the exporter and webhook deliveries without the web server",
+				Action: func(cmd *cli.Context) error {
+					m, err := newMirage(cmd)
+					if err != nil {
+						return err
+					}
+
+					m.RunExporter()
+					m.RunWebhookDeliveries()
+					m.Wait()
+
+					return nil
+				},
+			},
+			{
+				Name:  "fill-redis",
+				Usage: "fill the redis handle caches from postgres",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "skip",
+						Usage: "number of did handles to skip, for resuming a previous fill",
+					},
+				},
+				Action: func(cmd *cli.Context) error {
+					m, err := newMirage(cmd)
+					if err != nil {
+						return err
+					}
+
+					return m.FillRedis(cmd.Int("skip"))
+				},
+			},
+			{
+				Name:  "rebuild-cache",
+				Usage: "clear mirage's redis keys and refill the handle caches from postgres",
+				Action: func(cmd *cli.Context) error {
+					m, err := newMirage(cmd)
+					if err != nil {
+						return err
+					}
+
+					return m.RebuildCache()
+				},
+			},
+			{
+				Name:      "import",
+				Usage:     "bulk import a jsonl plc export snapshot, which may be gzip or zstd compressed",
+				ArgsUsage: "<snapshot>",
+				Action: func(cmd *cli.Context) error {
+					if cmd.NArg() != 1 {
+						return fmt.Errorf("expected a path to a snapshot")
+					}
+
+					m, err := newMirage(cmd)
+					if err != nil {
+						return err
+					}
+
+					return m.ImportSnapshot(cmd.Context, cmd.Args().First())
+				},
+			},
+			{
+				Name:  "backfill",
+				Usage: "fill handle history and did aliases from operations that were stored before they were recorded",
+				Action: func(cmd *cli.Context) error {
+					m, err := newMirage(cmd)
+					if err != nil {
+						return err
+					}
+
+					return m.Backfill(cmd.Context)
+				},
+			},
+			{
+				Name:  "verify",
+				Usage: "re-verify every stored operation",
+				Action: func(cmd *cli.Context) error {
+					m, err := newMirage(cmd)
+					if err != nil {
+						return err
+					}
+
+					return m.VerifyAll(cmd.Context)
+				},
+			},
+		},
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func newMirage(cmd *cli.Context) (*mirage.Mirage, error) {
+	return mirage.NewMirage(cmd.Context, &mirage.MirageArgs{
+		PostgresHost:    cmd.String("postgres-host"),
+		PostgresPort:    cmd.String("postgres-port"),
+		PostgresDb:      cmd.String("postgres-db"),
+		PostgresUser:    cmd.String("postgres-user"),
+		PostgresPass:    cmd.String("postgres-pass"),
+		RedisHost:       cmd.String("redis-host"),
+		LogLevel:        cmd.String("log-level"),
+		Upstream:        cmd.String("upstream"),
+		PollInterval:    cmd.Duration("poll-interval"),
+		CatchUpInterval: cmd.Duration("catch-up-interval"),
+		PageSize:        cmd.Int("page-size"),
+		VerifyHandles:   cmd.Bool("verify-handles"),
+		LocalCacheSize:  cmd.Int("local-cache-size"),
+		LocalCacheTTL:   cmd.Duration("local-cache-ttl"),
+	})
+}
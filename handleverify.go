@@ -0,0 +1,177 @@
+package mirage
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+var (
+	handleVerificationPrefix = "handle_verification/"
+
+	// how long verification results are cached for. failures are cached for less time, since they are
+	// often caused by a handle that is still being set up.
+	handleVerificationTTL        = 6 * time.Hour
+	handleVerificationFailureTTL = 15 * time.Minute
+
+	handleVerifierWorkers = 4
+)
+
+// HandleVerification is the result of checking a handle in both directions: the handle has to
+// resolve to the did through dns or https, and the did's current operation has to claim the handle.
+type HandleVerification struct {
+	Handle      string    `json:"handle"`
+	Did         string    `json:"did"`
+	Verified    bool      `json:"verified"`
+	ResolvedDid string    `json:"resolvedDid,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	VerifiedAt  time.Time `json:"verifiedAt"`
+}
+
+// VerifyHandle verifies that a handle and did point at each other. A cached result is returned if
+// there is one for the same did, otherwise the handle is resolved and the result is cached.
+func (m *Mirage) VerifyHandle(handle, did string) (*HandleVerification, error) {
+	key := redisPrefix + handleVerificationPrefix + handle
+
+	cached, err := m.r.Get(key).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	if err == nil {
+		var hv HandleVerification
+		if err := json.Unmarshal([]byte(cached), &hv); err == nil && hv.Did == did {
+			return &hv, nil
+		}
+	}
+
+	hv, err := m.verifyHandle(handle, did)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := handleVerificationTTL
+	if !hv.Verified {
+		ttl = handleVerificationFailureTTL
+	}
+
+	b, err := json.Marshal(hv)
+	if err != nil {
+		return nil, err
+	}
+	m.r.Set(key, b, ttl)
+
+	return hv, nil
+}
+
+// verifyHandle does the actual verification. Failing to resolve the handle is a verification
+// failure rather than an error, only problems on our side are returned as errors.
+func (m *Mirage) verifyHandle(handle, did string) (*HandleVerification, error) {
+	hv := &HandleVerification{
+		Handle:     handle,
+		Did:        did,
+		VerifiedAt: time.Now().UTC(),
+	}
+
+	last, err := m.GetLastOp(did)
+	if errors.Is(err, ErrDidNotFound) {
+		hv.Error = ErrDidNotFound.Error()
+		return hv, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	op := last.Operation.Normalized()
+	if op == nil {
+		hv.Error = ErrDidTombstoned.Error()
+		return hv, nil
+	}
+
+	if !slices.Contains(op.AlsoKnownAs, "at://"+handle) {
+		hv.Error = "did does not claim the handle"
+		return hv, nil
+	}
+
+	resolved, err := m.ResolveHandle(m.ctx, handle)
+	if err != nil {
+		hv.Error = err.Error()
+		return hv, nil
+	}
+
+	hv.ResolvedDid = resolved
+	if resolved != did {
+		hv.Error = "handle resolves to a different did"
+		return hv, nil
+	}
+
+	hv.Verified = true
+
+	return hv, nil
+}
+
+// runHandleVerifier verifies handles in the background as the exporter changes them, so that
+// results are usually already cached by the time they are asked for. Changes from operations older
+// than the catch up threshold are skipped, since the handle has likely changed again since.
+func (m *Mirage) runHandleVerifier() {
+	evts := make(chan *HandleEvent)
+
+	for range handleVerifierWorkers {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for evt := range evts {
+				if _, err := m.VerifyHandle(evt.NewHandle, evt.Did); err != nil {
+					m.logger.Error("failed to verify handle", "handle", evt.NewHandle, "did", evt.Did, "err", err)
+				}
+			}
+		}()
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer close(evts)
+
+		for {
+			sub := m.handleEvents.subscribe()
+
+		recv:
+			for {
+				select {
+				case <-m.ctx.Done():
+					m.handleEvents.unsubscribe(sub)
+					return
+				case evt, ok := <-sub:
+					if !ok {
+						// verification fell behind, which is fine since results are verified on demand anyway
+						break recv
+					}
+
+					if evt.OldHandle != "" && evt.OldHandle != evt.NewHandle {
+						m.r.Del(redisPrefix + handleVerificationPrefix + evt.OldHandle)
+					}
+
+					if evt.Tombstoned || evt.NewHandle == "" {
+						continue
+					}
+
+					if t, err := time.Parse(time.RFC3339Nano, evt.At); err != nil || time.Since(t) > catchUpThreshold {
+						continue
+					}
+
+					select {
+					case evts <- evt:
+					case <-m.ctx.Done():
+						m.handleEvents.unsubscribe(sub)
+						return
+					}
+				}
+			}
+
+			m.logger.Warn("handle verifier fell behind, resubscribing")
+		}
+	}()
+}
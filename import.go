@@ -0,0 +1,370 @@
+package mirage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	importBatchSize = 100_000
+
+	// imported entries are stored as invalid with this reason until they have been verified, so that
+	// they aren't served in the meantime
+	unverifiedReason = "not verified yet"
+
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Conn
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+type importLine struct {
+	Did       string          `json:"did"`
+	Operation json.RawMessage `json:"operation"`
+	Cid       string          `json:"cid"`
+	CreatedAt string          `json:"createdAt"`
+}
+
+// ImportSnapshot bulk loads a jsonl dump of plc.directory's export (optionally gzip or zstd
+// compressed) into plc_entries using COPY, verifies them, derives did_handles for every imported did,
+// and moves the export cursor to the last imported createdAt so that the exporter picks up where the
+// dump ends.
+//
+// Entries are stored as invalid until they have been verified, and the dump's nullified flags are
+// ignored, since verification nullifies operations itself. If the import stops before verification
+// is done, the remaining entries stay hidden until VerifyAll is run. Entries that we already have are
+// skipped. The redis handle caches are not filled here, run RebuildCache once the import is done.
+func (m *Mirage) ImportSnapshot(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	rdr, err := decompressSnapshot(f)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	sqlDb, err := m.db.c.DB()
+	if err != nil {
+		return fmt.Errorf("failed to get db: %w", err)
+	}
+
+	conn, err := sqlDb.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get db conn: %w", err)
+	}
+	defer conn.Close()
+
+	first := ""
+	last := ""
+	lastCid := ""
+	total := 0
+
+	if err := conn.Raw(func(driverConn any) error {
+		pc := driverConn.(*stdlib.Conn).Conn()
+
+		if _, err := pc.Exec(ctx, "CREATE TEMP TABLE IF NOT EXISTS plc_entries_import (did text, operation jsonb, cid text, created_at text)"); err != nil {
+			return fmt.Errorf("failed to create import table: %w", err)
+		}
+		defer pc.Exec(context.Background(), "DROP TABLE IF EXISTS plc_entries_import")
+
+		br := bufio.NewReaderSize(rdr, 1024*1024)
+		rows := make([][]any, 0, importBatchSize)
+
+		flush := func() error {
+			if len(rows) == 0 {
+				return nil
+			}
+
+			if _, err := pc.CopyFrom(ctx, pgx.Identifier{"plc_entries_import"}, []string{"did", "operation", "cid", "created_at"}, pgx.CopyFromRows(rows)); err != nil {
+				return fmt.Errorf("failed to copy entries: %w", err)
+			}
+
+			if _, err := pc.Exec(ctx, "INSERT INTO plc_entries (did, operation, cid, created_at, invalid, invalid_reason) SELECT did, operation, cid, created_at, true, $1 FROM plc_entries_import ON CONFLICT (cid) DO NOTHING", unverifiedReason); err != nil {
+				return fmt.Errorf("failed to insert entries: %w", err)
+			}
+
+			if _, err := pc.Exec(ctx, "TRUNCATE plc_entries_import"); err != nil {
+				return fmt.Errorf("failed to truncate import table: %w", err)
+			}
+
+			total += len(rows)
+			rows = rows[:0]
+
+			m.logger.Info("imported snapshot batch", "total", total, "cursor", last)
+
+			return nil
+		}
+
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			b, err := br.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("failed to read snapshot: %w", err)
+			}
+
+			if b = bytes.TrimSpace(b); len(b) > 0 {
+				var line importLine
+				if err := json.Unmarshal(b, &line); err != nil {
+					m.logger.Error("failed to unmarshal snapshot line", "err", err)
+				} else {
+					if first == "" || line.CreatedAt < first {
+						first = line.CreatedAt
+					}
+					if line.CreatedAt >= last {
+						last = line.CreatedAt
+						lastCid = line.Cid
+					}
+
+					rows = append(rows, []any{line.Did, string(line.Operation), line.Cid, line.CreatedAt})
+					if len(rows) >= importBatchSize {
+						if err := flush(); err != nil {
+							return err
+						}
+					}
+				}
+			}
+
+			if err == io.EOF {
+				break
+			}
+		}
+
+		return flush()
+	}); err != nil {
+		return err
+	}
+
+	if total == 0 {
+		m.logger.Info("snapshot was empty")
+		return nil
+	}
+
+	m.logger.Info("verifying imported entries", "from", first, "to", last)
+
+	if err := m.verifyRange(ctx, first, last); err != nil {
+		return fmt.Errorf("failed to verify imported entries: %w", err)
+	}
+
+	m.logger.Info("deriving did handles", "from", first, "to", last)
+
+	if err := deriveDidHandles(ctx, conn, first, last); err != nil {
+		return fmt.Errorf("failed to derive did handles: %w", err)
+	}
+
+	m.logger.Info("deriving did aliases", "from", first, "to", last)
+
+	if err := deriveDidAliases(ctx, conn, first, last); err != nil {
+		return fmt.Errorf("failed to derive did aliases: %w", err)
+	}
+
+	m.logger.Info("deriving handle history", "from", first, "to", last)
+
+	if _, err := conn.ExecContext(ctx, deriveHandleHistoryQuery, first, last); err != nil {
+		return fmt.Errorf("failed to derive handle history: %w", err)
+	}
+
+	if _, err := conn.ExecContext(ctx, deriveAliasHistoryQuery, first, last); err != nil {
+		return fmt.Errorf("failed to derive alias history: %w", err)
+	}
+
+	// moves the redis cursor of older deployments over first, so that it isn't lost
+	if _, err := m.getCursor(); err != nil {
+		return fmt.Errorf("failed to get after: %w", err)
+	}
+
+	if err := updateSyncState(m.db.c, &SyncState{
+		Cursor:  last,
+		LastCid: lastCid,
+		Entries: int64(total),
+	}); err != nil {
+		return fmt.Errorf("failed to update sync state: %w", err)
+	}
+
+	m.logger.Info("finished importing snapshot", "total", total, "cursor", last)
+
+	return nil
+}
+
+// deriveDidHandles upserts did_handles from the head of every did that has operations in the given
+// range. Rows are only overwritten by newer operations, so importing an older snapshot on top of
+// live data leaves the live handles alone. Both the flat and the older wrapped jsonb shapes of the
+// operation column are understood.
+func deriveDidHandles(ctx context.Context, conn *sql.Conn, from, to string) error {
+	_, err := conn.ExecContext(ctx, `
+INSERT INTO did_handles (did, handle, updated_at, tombstoned)
+SELECT did,
+	COALESCE(CASE WHEN op->>'type' = 'create' THEN regexp_replace(op->>'handle', '^(at|https?)://', '')
+		ELSE (SELECT substr(uri, 6) FROM jsonb_array_elements_text(op->'alsoKnownAs') WITH ORDINALITY AS aka(uri, pos) WHERE uri LIKE 'at://%' ORDER BY pos LIMIT 1) END, ''),
+	created_at::timestamptz,
+	op->>'type' = 'plc_tombstone'
+FROM (
+	SELECT DISTINCT ON (did) did, created_at,
+		CASE WHEN operation ? 'type' THEN operation
+		ELSE COALESCE(NULLIF(operation->'PlcOperation', 'null'::jsonb), NULLIF(operation->'PlcTombstone', 'null'::jsonb), operation->'LegacyPlcOperation') END AS op
+	FROM plc_entries
+	WHERE did IN (SELECT DISTINCT did FROM plc_entries WHERE created_at >= $1 AND created_at <= $2)
+		AND NOT invalid AND NOT nullified
+	ORDER BY did, created_at DESC
+) heads
+ON CONFLICT (did) DO UPDATE SET
+	handle = CASE WHEN excluded.tombstoned THEN did_handles.handle ELSE excluded.handle END,
+	updated_at = excluded.updated_at,
+	tombstoned = excluded.tombstoned
+WHERE excluded.updated_at >= did_handles.updated_at`, from, to)
+	return err
+}
+
+// deriveDidAliases replaces did_aliases with the alsoKnownAs uris of the head of every did that has
+// operations in the given range
+func deriveDidAliases(ctx context.Context, conn sqlExecer, from, to string) error {
+	if _, err := conn.ExecContext(ctx, "DELETE FROM did_aliases WHERE did IN (SELECT DISTINCT did FROM plc_entries WHERE created_at >= $1 AND created_at <= $2)", from, to); err != nil {
+		return err
+	}
+
+	_, err := conn.ExecContext(ctx, `
+INSERT INTO did_aliases (did, position, uri, handle)
+SELECT did, aka.pos - 1, aka.uri, CASE WHEN aka.uri LIKE 'at://%' THEN substr(aka.uri, 6) ELSE '' END
+FROM (
+	SELECT DISTINCT ON (did) did,
+		CASE WHEN operation ? 'type' THEN operation
+		ELSE COALESCE(NULLIF(operation->'PlcOperation', 'null'::jsonb), NULLIF(operation->'PlcTombstone', 'null'::jsonb), operation->'LegacyPlcOperation') END AS op
+	FROM plc_entries
+	WHERE did IN (SELECT DISTINCT did FROM plc_entries WHERE created_at >= $1 AND created_at <= $2)
+		AND NOT invalid AND NOT nullified
+	ORDER BY did, created_at DESC
+) heads,
+jsonb_array_elements_text(CASE WHEN op->>'type' = 'create' THEN jsonb_build_array('at://' || regexp_replace(op->>'handle', '^(at|https?)://', ''))
+	ELSE COALESCE(op->'alsoKnownAs', '[]'::jsonb) END) WITH ORDINALITY AS aka(uri, pos)`, from, to)
+	return err
+}
+
+// deriveHandleHistoryQuery fills handle_history from the canonical chain of every did that has
+// operations in the given range, in the same way that the exporter records it. Rows that already
+// exist are left alone.
+var deriveHandleHistoryQuery = `
+INSERT INTO handle_history (did, handle, prev_handle, cid, is_primary, created_at)
+SELECT did, handle, COALESCE(prev_handle, ''), cid, true, created_at
+FROM (
+	SELECT did, cid, created_at, handle, LAG(handle) OVER (PARTITION BY did ORDER BY created_at) AS prev_handle
+	FROM (
+		SELECT did, cid, created_at,
+			COALESCE(CASE WHEN op->>'type' = 'create' THEN regexp_replace(op->>'handle', '^(at|https?)://', '')
+				ELSE (SELECT substr(uri, 6) FROM jsonb_array_elements_text(op->'alsoKnownAs') WITH ORDINALITY AS aka(uri, pos) WHERE uri LIKE 'at://%' ORDER BY pos LIMIT 1) END, '') AS handle
+		FROM (
+			SELECT did, cid, created_at,
+				CASE WHEN operation ? 'type' THEN operation
+				ELSE COALESCE(NULLIF(operation->'PlcOperation', 'null'::jsonb), NULLIF(operation->'PlcTombstone', 'null'::jsonb), operation->'LegacyPlcOperation') END AS op
+			FROM plc_entries
+			WHERE did IN (SELECT DISTINCT did FROM plc_entries WHERE created_at >= $1 AND created_at <= $2)
+				AND NOT invalid AND NOT nullified
+		) ops
+	) handles
+) transitions
+WHERE prev_handle IS NULL OR prev_handle <> handle
+ON CONFLICT DO NOTHING`
+
+// deriveAliasHistoryQuery fills handle_history with the additions and removals of every at:// handle
+// other than the primary one, for every did that has operations in the given range
+var deriveAliasHistoryQuery = `
+WITH ops AS (
+	SELECT did, cid, created_at, LAG(cid) OVER (PARTITION BY did ORDER BY created_at) AS prev_cid,
+		CASE WHEN operation ? 'type' THEN operation
+		ELSE COALESCE(NULLIF(operation->'PlcOperation', 'null'::jsonb), NULLIF(operation->'PlcTombstone', 'null'::jsonb), operation->'LegacyPlcOperation') END AS op
+	FROM plc_entries
+	WHERE did IN (SELECT DISTINCT did FROM plc_entries WHERE created_at >= $1 AND created_at <= $2)
+		AND NOT invalid AND NOT nullified
+), handles AS (
+	SELECT ops.cid, substr(aka.uri, 6) AS handle, aka.pos
+	FROM ops, jsonb_array_elements_text(CASE WHEN jsonb_typeof(ops.op->'alsoKnownAs') = 'array' THEN ops.op->'alsoKnownAs' ELSE '[]'::jsonb END) WITH ORDINALITY AS aka(uri, pos)
+	WHERE aka.uri LIKE 'at://%'
+), secondary AS (
+	SELECT DISTINCT h.cid, h.handle
+	FROM handles h
+	WHERE h.handle <> (SELECT p.handle FROM handles p WHERE p.cid = h.cid ORDER BY p.pos LIMIT 1)
+)
+INSERT INTO handle_history (did, handle, prev_handle, cid, is_primary, created_at)
+SELECT ops.did, s.handle, '', ops.cid, false, ops.created_at
+FROM ops JOIN secondary s ON s.cid = ops.cid
+WHERE NOT EXISTS (SELECT 1 FROM secondary p WHERE p.cid = ops.prev_cid AND p.handle = s.handle)
+UNION ALL
+SELECT ops.did, '', p.handle, ops.cid, false, ops.created_at
+FROM ops JOIN secondary p ON p.cid = ops.prev_cid
+WHERE NOT EXISTS (SELECT 1 FROM secondary s WHERE s.cid = ops.cid AND s.handle = p.handle)
+ON CONFLICT DO NOTHING`
+
+// Backfill fills handle_history and did_aliases from every operation that we have. It only needs to
+// be run once, for operations that were stored before those tables existed.
+func (m *Mirage) Backfill(ctx context.Context) error {
+	// gorm would treat the jsonb ? operator as a placeholder, so this skips it
+	sqlDb, err := m.db.c.DB()
+	if err != nil {
+		return fmt.Errorf("failed to get db: %w", err)
+	}
+
+	m.logger.Info("backfilling handle history")
+
+	if _, err := sqlDb.ExecContext(ctx, deriveHandleHistoryQuery, "", "9999"); err != nil {
+		return fmt.Errorf("failed to derive handle history: %w", err)
+	}
+
+	if _, err := sqlDb.ExecContext(ctx, deriveAliasHistoryQuery, "", "9999"); err != nil {
+		return fmt.Errorf("failed to derive alias history: %w", err)
+	}
+
+	m.logger.Info("backfilling did aliases")
+
+	if err := deriveDidAliases(ctx, sqlDb, "", "9999"); err != nil {
+		return fmt.Errorf("failed to derive did aliases: %w", err)
+	}
+
+	return nil
+}
+
+// decompressSnapshot wraps the snapshot in a gzip or zstd reader if its magic bytes say that it is
+// compressed
+func decompressSnapshot(f *os.File) (io.ReadCloser, error) {
+	br := bufio.NewReader(f)
+
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		return gr, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
@@ -0,0 +1,69 @@
+package mirage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImportSnapshotVerifies(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+
+	id, genesis := newTestIdentity(t, start, "user.test")
+	update := id.update(t, start.Add(time.Second), "new.test")
+	_, forged := newTestIdentity(t, start.Add(2*time.Second), "forged.test")
+	forged.Did = "did:plc:aaaaaaaaaaaaaaaaaaaaaaaa"
+
+	// nothing nullifies the update, so the dump's flag is ignored
+	update.Nullified = true
+
+	path := filepath.Join(t.TempDir(), "snapshot.jsonl")
+	if err := os.WriteFile(path, pageOf(t, genesis, update, forged), 0o644); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	m, _ := newTestMirage(t, nil)
+
+	if err := m.ImportSnapshot(context.Background(), path); err != nil {
+		t.Fatalf("failed to import snapshot: %v", err)
+	}
+
+	var entries []PlcEntry
+	if err := m.db.c.Raw("SELECT * FROM plc_entries ORDER BY created_at").Scan(&entries).Error; err != nil {
+		t.Fatalf("failed to get entries: %v", err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	for _, entry := range entries[:2] {
+		if entry.Invalid || entry.Nullified {
+			t.Fatalf("expected %s to be valid and not nullified: %s", entry.Cid, entry.InvalidReason)
+		}
+	}
+
+	if !entries[2].Invalid || entries[2].InvalidReason == unverifiedReason {
+		t.Fatalf("expected the forged entry to fail verification, got %+v", entries[2])
+	}
+
+	var dh DidHandle
+	if err := m.db.c.Raw("SELECT * FROM did_handles WHERE did = ?", id.did).Scan(&dh).Error; err != nil {
+		t.Fatalf("failed to get did handle: %v", err)
+	}
+
+	if dh.Handle != "new.test" {
+		t.Fatalf("expected the did handle to be new.test, got %q", dh.Handle)
+	}
+
+	state, err := m.GetSyncState()
+	if err != nil {
+		t.Fatalf("failed to get sync state: %v", err)
+	}
+
+	if state == nil || state.Cursor != forged.CreatedAt {
+		t.Fatalf("expected the cursor to move to the end of the snapshot, got %+v", state)
+	}
+}
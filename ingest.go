@@ -0,0 +1,888 @@
+package mirage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	defaultPollInterval    = 1 * time.Second
+	defaultCatchUpInterval = 600 * time.Millisecond
+	defaultPageSize        = 1000
+
+	// while the cursor is further behind than this, pages are requested at the catch up interval
+	catchUpThreshold = 1 * time.Hour
+
+	insertBatchSize = 500
+	syncStateId     = 1
+
+	// how long the exporter waits to resolve a handle that is claimed by more than one did
+	ingestResolveTimeout = 1 * time.Second
+)
+
+// RunExporter starts ingesting operations from the upstream in the background. It runs until the
+// context passed to NewMirage is cancelled.
+func (m *Mirage) RunExporter() {
+	if m.verifyHandles {
+		m.runHandleVerifier()
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		after, err := m.getCursor()
+		if err != nil {
+			m.logger.Error("failed to get after", "err", err)
+			return
+		}
+
+		for {
+			m.logger.Info("exporting", "cursor", after)
+
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(m.exportWait(after)):
+			}
+
+			b, err := m.upstream.Export(m.ctx, after, m.pageSize)
+			if err != nil {
+				m.logger.Error("failed to get export", "err", err)
+				continue
+			}
+
+			next, err := m.ingestPage(b, after)
+			if err != nil {
+				// nothing from the page was committed, so the same page is retried
+				m.logger.Error("failed to ingest page", "cursor", after, "err", err)
+				continue
+			}
+
+			after = next
+		}
+	}()
+}
+
+// exportWait returns how long to wait before requesting the page after the cursor. Pages are
+// requested at the catch up interval while the cursor is far behind, and at the poll interval once
+// ingestion has caught up.
+func (m *Mirage) exportWait(after string) time.Duration {
+	if after == "" {
+		return m.pollInterval
+	}
+
+	t, _ := time.Parse(time.RFC3339Nano, after)
+	if time.Since(t) > catchUpThreshold {
+		return m.catchUpInterval
+	}
+
+	return m.pollInterval
+}
+
+// GetSyncState returns the ingestion state, or nil if nothing has been ingested yet
+func (m *Mirage) GetSyncState() (*SyncState, error) {
+	var states []SyncState
+	if err := m.db.c.Raw("SELECT * FROM sync_state WHERE id = ?", syncStateId).Scan(&states).Error; err != nil {
+		return nil, err
+	}
+
+	if len(states) == 0 {
+		return nil, nil
+	}
+
+	return &states[0], nil
+}
+
+// getCursor returns the export cursor from postgres. Older deployments kept the cursor in redis, so
+// if postgres doesn't have one yet the redis cursor is moved over to postgres.
+func (m *Mirage) getCursor() (string, error) {
+	state, err := m.GetSyncState()
+	if err != nil {
+		return "", err
+	}
+
+	if state != nil {
+		return state.Cursor, nil
+	}
+
+	after, err := m.r.Get(redisPrefix + "after").Result()
+	if err == redis.Nil {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	m.logger.Info("moving cursor from redis to postgres", "cursor", after)
+
+	if err := updateSyncState(m.db.c, &SyncState{Cursor: after}); err != nil {
+		return "", err
+	}
+
+	m.r.Del(redisPrefix + "after")
+
+	return after, nil
+}
+
+// updateSyncState adds the supplied counts to the stored stats using the supplied transaction. The
+// cursor and last cid are only moved if the supplied cursor is not behind the stored one.
+func updateSyncState(tx *gorm.DB, update *SyncState) error {
+	update.Id = uint(syncStateId)
+	update.UpdatedAt = time.Now()
+
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "id"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "cursor"}, Value: gorm.Expr("GREATEST(sync_state.cursor, excluded.cursor)")},
+			{Column: clause.Column{Name: "last_cid"}, Value: gorm.Expr("CASE WHEN excluded.cursor > sync_state.cursor THEN excluded.last_cid ELSE sync_state.last_cid END")},
+			{Column: clause.Column{Name: "entries"}, Value: gorm.Expr("sync_state.entries + excluded.entries")},
+			{Column: clause.Column{Name: "invalid_entries"}, Value: gorm.Expr("sync_state.invalid_entries + excluded.invalid_entries")},
+			{Column: clause.Column{Name: "pages"}, Value: gorm.Expr("sync_state.pages + excluded.pages")},
+			{Column: clause.Column{Name: "updated_at"}, Value: gorm.Expr("excluded.updated_at")},
+		},
+	}).Create(update).Error
+}
+
+// ingestPage stores every entry in an export page, along with the new cursor, in a single
+// transaction. The redis caches are only updated once the transaction has been committed, so a
+// failure part way through a page leaves nothing behind and the page can simply be retried.
+func (m *Mirage) ingestPage(b []byte, after string) (string, error) {
+	var entries []*PlcEntry
+	for _, pt := range strings.Split(string(b), "\n") {
+		if pt == "" {
+			continue
+		}
+
+		var entry PlcEntry
+		if err := json.Unmarshal([]byte(pt), &entry); err != nil {
+			m.logger.Error("failed to unmarshal export", "err", err)
+			continue
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if len(entries) == 0 {
+		return after, nil
+	}
+
+	// the cursor is sent back upstream, so it is only taken from an entry whose createdAt parses. such
+	// entries are still stored, flagged as invalid by verification.
+	cursor := after
+	lastCid := ""
+	for i := len(entries) - 1; i >= 0; i-- {
+		if _, err := time.Parse(time.RFC3339Nano, entries[i].CreatedAt); err == nil {
+			cursor = entries[i].CreatedAt
+			lastCid = entries[i].Cid
+			break
+		}
+	}
+
+	var heads, stored []*PlcEntry
+	var evts []*HandleEvent
+	var removedHandles map[string][]string
+	if err := m.db.c.Transaction(func(tx *gorm.DB) error {
+		store := &entryStore{
+			db:    tx,
+			byCid: map[string]*PlcEntry{},
+		}
+
+		if err := store.preload(entries); err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := m.ingestEntry(store, entry); err != nil {
+				return err
+			}
+		}
+
+		// entries we already have are skipped by ingestEntry, but a concurrent import may have written
+		// some of them since. everything below only acts on the entries that this page actually inserted.
+		inserted, err := insertEntries(tx, store.pending)
+		if err != nil {
+			return fmt.Errorf("failed to create entries: %w", err)
+		}
+		store.pending = inserted
+
+		stored = store.pending
+		heads = store.heads()
+		handleEvts, removed, err := upsertDidHandles(tx, heads)
+		if err != nil {
+			return fmt.Errorf("failed to upsert did handles: %w", err)
+		}
+		evts = handleEvts
+		removedHandles = removed
+
+		if err := recordHandleHistory(tx, store); err != nil {
+			return fmt.Errorf("failed to record handle history: %w", err)
+		}
+
+		if err := enqueueWebhookDeliveries(tx, store); err != nil {
+			return fmt.Errorf("failed to enqueue webhook deliveries: %w", err)
+		}
+
+		invalid := 0
+		for _, entry := range store.pending {
+			if entry.Invalid {
+				invalid++
+			}
+		}
+
+		if err := updateSyncState(tx, &SyncState{
+			Cursor:         cursor,
+			LastCid:        lastCid,
+			Entries:        int64(len(store.pending)),
+			InvalidEntries: int64(invalid),
+			Pages:          1,
+		}); err != nil {
+			return fmt.Errorf("failed to update sync state: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return after, err
+	}
+
+	for _, head := range heads {
+		m.cacheHead(head, removedHandles[head.Did])
+	}
+
+	for _, entry := range stored {
+		if !entry.Invalid {
+			m.entries.publish(entry)
+		}
+	}
+
+	for _, evt := range evts {
+		m.handleEvents.publish(evt)
+	}
+
+	return cursor, nil
+}
+
+// insertEntries writes entries that aren't already stored, returning the ones that were inserted with
+// their ids set
+func insertEntries(tx *gorm.DB, entries []*PlcEntry) ([]*PlcEntry, error) {
+	var inserted []*PlcEntry
+	for batch := range slices.Chunk(entries, insertBatchSize) {
+		var sb strings.Builder
+		sb.WriteString("INSERT INTO plc_entries (did, operation, cid, nullified, created_at, invalid, invalid_reason) VALUES ")
+
+		args := make([]any, 0, len(batch)*7)
+		for i, entry := range batch {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString("(?, ?, ?, ?, ?, ?, ?)")
+			args = append(args, entry.Did, &entry.Operation, entry.Cid, entry.Nullified, entry.CreatedAt, entry.Invalid, entry.InvalidReason)
+		}
+
+		sb.WriteString(" ON CONFLICT (cid) DO NOTHING RETURNING id, cid")
+
+		var rows []struct {
+			Id  uint
+			Cid string
+		}
+		if err := tx.Raw(sb.String(), args...).Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+
+		insertedIds := map[string]uint{}
+		for _, row := range rows {
+			insertedIds[row.Cid] = row.Id
+		}
+
+		for _, entry := range batch {
+			if id, ok := insertedIds[entry.Cid]; ok {
+				entry.ID = id
+				inserted = append(inserted, entry)
+			}
+		}
+	}
+
+	return inserted, nil
+}
+
+// ingestEntry verifies a single entry and adds it to the store. Entries that fail verification are
+// still stored, but flagged as invalid. Only errors that should abort the page are returned.
+func (m *Mirage) ingestEntry(store *entryStore, entry *PlcEntry) error {
+	known, err := store.isKnown(entry.Cid)
+	if err != nil {
+		return fmt.Errorf("failed to check for entry: %w", err)
+	}
+
+	if known {
+		return nil
+	}
+
+	// the upstream's nullified flag isn't trusted. operations are only nullified here, by a recovery
+	// operation that passes verification.
+	entry.Nullified = false
+
+	if err := store.verifyEntry(entry); err != nil {
+		if !errors.Is(err, ErrInvalidOperation) {
+			return fmt.Errorf("failed to verify entry %s: %w", entry.Cid, err)
+		}
+
+		m.logger.Warn("rejecting invalid entry", "did", entry.Did, "cid", entry.Cid, "err", err)
+		entry.Invalid = true
+		entry.InvalidReason = err.Error()
+	}
+
+	if !entry.Invalid && !entry.Nullified {
+		if err := store.nullifyForkedOps(entry); err != nil {
+			return fmt.Errorf("failed to nullify forked ops: %w", err)
+		}
+	}
+
+	store.add(entry)
+
+	return nil
+}
+
+// upsertDidHandles writes the current primary handle (or tombstone) of each did to did_handles, and
+// replaces the did's alsoKnownAs uris in did_aliases. Dids without a handle are recorded with an
+// empty one. A tombstone keeps the last known handle, and rows are only overwritten by newer
+// operations. An event is returned for every row whose handle or tombstone has changed, along with
+// the handles that were in each replaced did's did_aliases rows.
+func upsertDidHandles(tx *gorm.DB, heads []*PlcEntry) ([]*HandleEvent, map[string][]string, error) {
+	var dhs []DidHandle
+	var dhHeads []*PlcEntry
+	for _, head := range heads {
+		// verification rejects entries whose createdAt doesn't parse, so this shouldn't happen, but an
+		// error here would fail the page forever
+		t, err := time.Parse(time.RFC3339Nano, head.CreatedAt)
+		if err != nil {
+			continue
+		}
+
+		dhHeads = append(dhHeads, head)
+
+		if head.Operation.PlcTombstone != nil {
+			dhs = append(dhs, DidHandle{
+				Did:        head.Did,
+				UpdatedAt:  t,
+				Tombstoned: true,
+			})
+			continue
+		}
+
+		handle, _ := entryHandle(head)
+
+		dhs = append(dhs, DidHandle{
+			Did:       head.Did,
+			Handle:    handle,
+			UpdatedAt: t,
+		})
+	}
+
+	if len(dhs) == 0 {
+		return nil, nil, nil
+	}
+
+	dids := make([]string, len(dhs))
+	for i, dh := range dhs {
+		dids[i] = dh.Did
+	}
+
+	var existing []DidHandle
+	if err := tx.Raw("SELECT * FROM did_handles WHERE did IN ? FOR UPDATE", dids).Scan(&existing).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to get existing did handles: %w", err)
+	}
+
+	byDid := map[string]DidHandle{}
+	for _, dh := range existing {
+		byDid[dh.Did] = dh
+	}
+
+	var evts []*HandleEvent
+	var aliased []string
+	var aliases []DidAlias
+	for i, dh := range dhs {
+		prev, ok := byDid[dh.Did]
+		if ok && dh.UpdatedAt.Before(prev.UpdatedAt) {
+			continue
+		}
+
+		aliased = append(aliased, dh.Did)
+		if op := dhHeads[i].Operation.Normalized(); op != nil {
+			for pos, uri := range op.AlsoKnownAs {
+				aliases = append(aliases, DidAlias{
+					Did:      dh.Did,
+					Position: pos,
+					Uri:      uri,
+					Handle:   akaHandle(uri),
+				})
+			}
+		}
+
+		if ok && ((dh.Handle == prev.Handle && dh.Tombstoned == prev.Tombstoned) || (dh.Tombstoned && prev.Tombstoned)) {
+			continue
+		}
+
+		evt := &HandleEvent{
+			Did:        dh.Did,
+			OldHandle:  prev.Handle,
+			NewHandle:  dh.Handle,
+			Tombstoned: dh.Tombstoned,
+			At:         dh.UpdatedAt.UTC().Format(createdAtFormat),
+		}
+		if prev.Tombstoned {
+			evt.OldHandle = ""
+		}
+		evts = append(evts, evt)
+	}
+
+	if err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "did"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "handle"}, Value: gorm.Expr("CASE WHEN excluded.tombstoned THEN did_handles.handle ELSE excluded.handle END")},
+			{Column: clause.Column{Name: "updated_at"}, Value: gorm.Expr("excluded.updated_at")},
+			{Column: clause.Column{Name: "tombstoned"}, Value: gorm.Expr("excluded.tombstoned")},
+		},
+		// a replayed page must not roll a did back to an older handle
+		Where: clause.Where{Exprs: []clause.Expression{gorm.Expr("excluded.updated_at >= did_handles.updated_at")}},
+	}).CreateInBatches(dhs, insertBatchSize).Error; err != nil {
+		return nil, nil, err
+	}
+
+	removed := map[string][]string{}
+	if len(aliased) > 0 {
+		var prevAliases []DidAlias
+		if err := tx.Raw("DELETE FROM did_aliases WHERE did IN ? RETURNING *", aliased).Scan(&prevAliases).Error; err != nil {
+			return nil, nil, fmt.Errorf("failed to delete did aliases: %w", err)
+		}
+
+		for _, alias := range prevAliases {
+			if alias.Handle != "" {
+				removed[alias.Did] = append(removed[alias.Did], alias.Handle)
+			}
+		}
+	}
+
+	if len(aliases) > 0 {
+		if err := tx.CreateInBatches(aliases, insertBatchSize).Error; err != nil {
+			return nil, nil, fmt.Errorf("failed to create did aliases: %w", err)
+		}
+	}
+
+	return evts, removed, nil
+}
+
+// recordHandleHistory adds handle_history rows for every valid, non-nullified entry in the store:
+// one if its primary handle differs from the handle of the operation it follows, and one for each of
+// its other at:// handles that was added or removed
+func recordHandleHistory(tx *gorm.DB, store *entryStore) error {
+	var hhs []HandleHistory
+	for _, entry := range store.pending {
+		if entry.Invalid || entry.Nullified {
+			continue
+		}
+
+		var prev *PlcEntry
+		if p := entry.Operation.Prev(); p != nil {
+			pe, err := store.getEntry(entry.Did, *p)
+			if err != nil {
+				return fmt.Errorf("failed to get prev operation: %w", err)
+			}
+			prev = pe
+		}
+
+		prevHandle := ""
+		var prevSecondary []string
+		if prev != nil {
+			prevHandle, _ = entryHandle(prev)
+			prevSecondary = secondaryHandles(prev)
+		}
+
+		handle, _ := entryHandle(entry)
+		if entry.Operation.Prev() == nil || handle != prevHandle {
+			hhs = append(hhs, HandleHistory{
+				Did:        entry.Did,
+				Handle:     handle,
+				PrevHandle: prevHandle,
+				Cid:        entry.Cid,
+				IsPrimary:  true,
+				CreatedAt:  entry.CreatedAt,
+			})
+		}
+
+		secondary := secondaryHandles(entry)
+		for _, h := range secondary {
+			if !slices.Contains(prevSecondary, h) {
+				hhs = append(hhs, HandleHistory{
+					Did:       entry.Did,
+					Handle:    h,
+					Cid:       entry.Cid,
+					CreatedAt: entry.CreatedAt,
+				})
+			}
+		}
+
+		for _, h := range prevSecondary {
+			if !slices.Contains(secondary, h) {
+				hhs = append(hhs, HandleHistory{
+					Did:        entry.Did,
+					PrevHandle: h,
+					Cid:        entry.Cid,
+					CreatedAt:  entry.CreatedAt,
+				})
+			}
+		}
+	}
+
+	if len(hhs) == 0 {
+		return nil
+	}
+
+	// is_primary defaults to true for the rows from before it existed, so it has to be written even
+	// when it is false
+	return tx.Clauses(clause.OnConflict{
+		DoNothing: true,
+	}).Select("Did", "Handle", "PrevHandle", "Cid", "IsPrimary", "CreatedAt").CreateInBatches(hhs, insertBatchSize).Error
+}
+
+// entryHandle returns the primary handle of an entry, which is the first at:// uri in its
+// alsoKnownAs, without the prefix. ok is false for operations that don't have a handle.
+func entryHandle(entry *PlcEntry) (string, bool) {
+	op := entry.Operation.Normalized()
+	if op == nil {
+		return "", false
+	}
+
+	for _, uri := range op.AlsoKnownAs {
+		if handle := akaHandle(uri); handle != "" {
+			return handle, true
+		}
+	}
+
+	return "", false
+}
+
+// entryHandles returns every handle in an entry's alsoKnownAs, without the at:// prefix
+func entryHandles(entry *PlcEntry) []string {
+	op := entry.Operation.Normalized()
+	if op == nil {
+		return nil
+	}
+
+	var handles []string
+	for _, uri := range op.AlsoKnownAs {
+		if handle := akaHandle(uri); handle != "" {
+			handles = append(handles, handle)
+		}
+	}
+
+	return handles
+}
+
+// secondaryHandles returns the at:// handles of an entry other than its primary handle
+func secondaryHandles(entry *PlcEntry) []string {
+	handles := entryHandles(entry)
+	if len(handles) == 0 {
+		return nil
+	}
+
+	var secondary []string
+	for _, handle := range handles[1:] {
+		if handle != handles[0] && !slices.Contains(secondary, handle) {
+			secondary = append(secondary, handle)
+		}
+	}
+
+	return secondary
+}
+
+// akaHandle returns the handle of an at:// alsoKnownAs uri, or an empty string for any other uri
+func akaHandle(uri string) string {
+	handle, ok := strings.CutPrefix(uri, "at://")
+	if !ok {
+		return ""
+	}
+
+	return handle
+}
+
+// cacheHead updates the redis caches for a did whose head has changed
+func (m *Mirage) cacheHead(head *PlcEntry, prevHandles []string) {
+	m.setCachedHead(head.Did, head.Cid)
+
+	// the in-process caches are only invalidated once redis is up to date, otherwise they could be
+	// refilled from redis before it changes. prevHandles covers the handles that the did no longer
+	// lists, which may still be cached as pointing at it.
+	handles := append(entryHandles(head), prevHandles...)
+	if prevHandle, err := m.r.Get(redisPrefix + didHandlePrefix + head.Did).Result(); err == nil {
+		handles = append(handles, prevHandle)
+	}
+	defer m.invalidateLocal(head.Did, handles)
+
+	if head.Operation.PlcTombstone != nil {
+		m.uncacheDid(head.Did)
+		return
+	}
+
+	handle, ok := entryHandle(head)
+	if !ok {
+		m.uncacheDid(head.Did)
+		return
+	}
+
+	// drop the mapping for the did's previous handle so that it no longer resolves to this did
+	if prevHandle, err := m.r.Get(redisPrefix + didHandlePrefix + head.Did).Result(); err == nil && prevHandle != handle {
+		if curr, err := m.r.Get(redisPrefix + handleDidPrefix + prevHandle).Result(); err == nil && curr == head.Did {
+			m.r.Del(redisPrefix + handleDidPrefix + prevHandle)
+		}
+	}
+
+	m.r.Set(redisPrefix+didHandlePrefix+head.Did, handle, 0)
+
+	curr, err := m.r.Get(redisPrefix + handleDidPrefix + handle).Result()
+	if err != nil && err != redis.Nil {
+		m.logger.Error("failed to get handle did", "err", err)
+		return
+	}
+
+	if err == nil && curr != head.Did {
+		// another did claims this handle, so only take it over if the handle really points here. this
+		// holds up ingestion, so it gets less time than a regular resolution.
+		ctx, cancel := context.WithTimeout(m.ctx, ingestResolveTimeout)
+		res, err := m.ResolveHandle(ctx, handle)
+		cancel()
+		if err != nil {
+			m.logger.Error("failed to resolve handle", "err", err)
+			return
+		}
+
+		if res != head.Did {
+			m.logger.Error("handle did mismatch", "handle", handle, "did", head.Did, "resolved", res)
+			return
+		}
+	}
+
+	m.r.Set(redisPrefix+handleDidPrefix+handle, head.Did, 0)
+}
+
+// uncacheDid drops a did from the redis handle caches
+func (m *Mirage) uncacheDid(did string) {
+	if handle, err := m.r.Get(redisPrefix + didHandlePrefix + did).Result(); err == nil {
+		if curr, err := m.r.Get(redisPrefix + handleDidPrefix + handle).Result(); err == nil && curr == did {
+			m.r.Del(redisPrefix + handleDidPrefix + handle)
+		}
+	}
+
+	m.r.Del(redisPrefix + didHandlePrefix + did)
+}
+
+// entryStore looks up entries for verification. While a page is being ingested, its entries are
+// held in pending until they are written in a batch, so lookups check pending before the db. A page
+// is preloaded before it is verified, so that lookups only go to the db for entries that preload
+// didn't cover.
+type entryStore struct {
+	db      *gorm.DB
+	pending []*PlcEntry
+	byCid   map[string]*PlcEntry
+
+	// stored holds the preloaded entries by cid, with a nil entry for a cid that isn't stored
+	stored map[string]*PlcEntry
+	// latest holds the last valid, non-nullified entry of each preloaded did, including pending
+	// entries. It is nil for a did without any.
+	latest map[string]*PlcEntry
+}
+
+// preload looks up every entry of a page that is already stored, the prev of every entry, and the
+// last valid, non-nullified entry of every did in the page
+func (s *entryStore) preload(entries []*PlcEntry) error {
+	var cids, dids []string
+	for _, entry := range entries {
+		cids = append(cids, entry.Cid)
+		if prev := entry.Operation.Prev(); prev != nil {
+			cids = append(cids, *prev)
+		}
+		dids = append(dids, entry.Did)
+	}
+
+	var stored []*PlcEntry
+	if err := s.db.Raw("SELECT * FROM plc_entries WHERE cid IN ?", cids).Scan(&stored).Error; err != nil {
+		return fmt.Errorf("failed to get stored entries: %w", err)
+	}
+
+	s.stored = map[string]*PlcEntry{}
+	for _, cid := range cids {
+		s.stored[cid] = nil
+	}
+	for _, entry := range stored {
+		s.stored[entry.Cid] = entry
+	}
+
+	var latest []*PlcEntry
+	if err := s.db.Raw("SELECT DISTINCT ON (did) * FROM plc_entries WHERE did IN ? AND NOT invalid AND NOT nullified ORDER BY did, created_at DESC", dids).Scan(&latest).Error; err != nil {
+		return fmt.Errorf("failed to get latest entries: %w", err)
+	}
+
+	s.latest = map[string]*PlcEntry{}
+	for _, did := range dids {
+		s.latest[did] = nil
+	}
+	for _, entry := range latest {
+		s.latest[entry.Did] = entry
+	}
+
+	return nil
+}
+
+func (s *entryStore) add(entry *PlcEntry) {
+	s.pending = append(s.pending, entry)
+	s.byCid[entry.Cid] = entry
+
+	if latest, ok := s.latest[entry.Did]; ok && !entry.Invalid && !entry.Nullified && (latest == nil || entry.CreatedAt >= latest.CreatedAt) {
+		s.latest[entry.Did] = entry
+	}
+}
+
+// noneAfter returns whether the did is known to have no valid, non-nullified entry created after the
+// given time. It returns false when the did wasn't preloaded.
+func (s *entryStore) noneAfter(did, createdAt string) bool {
+	latest, ok := s.latest[did]
+	return ok && (latest == nil || latest.CreatedAt <= createdAt)
+}
+
+// getEntry returns a valid entry by did and cid, or nil if there isn't one
+func (s *entryStore) getEntry(did, cid string) (*PlcEntry, error) {
+	if entry, ok := s.byCid[cid]; ok {
+		if entry.Did != did || entry.Invalid {
+			return nil, nil
+		}
+		return entry, nil
+	}
+
+	if entry, ok := s.stored[cid]; ok {
+		if entry == nil || entry.Did != did || entry.Invalid {
+			return nil, nil
+		}
+		return entry, nil
+	}
+
+	var entries []PlcEntry
+	if err := s.db.Raw("SELECT * FROM plc_entries WHERE did = ? AND cid = ? AND NOT invalid LIMIT 1", did, cid).Scan(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	return &entries[0], nil
+}
+
+// firstCanonicalBetween returns the earliest valid, non-nullified entry for a did that was created
+// strictly between from and to, or nil if there isn't one
+func (s *entryStore) firstCanonicalBetween(did, from, to string) (*PlcEntry, error) {
+	if s.noneAfter(did, from) {
+		return nil, nil
+	}
+
+	var entries []PlcEntry
+	if err := s.db.Raw("SELECT * FROM plc_entries WHERE did = ? AND created_at > ? AND created_at < ? AND NOT invalid AND NOT nullified ORDER BY created_at ASC LIMIT 1", did, from, to).Scan(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	var first *PlcEntry
+	if len(entries) > 0 {
+		first = &entries[0]
+	}
+
+	for _, entry := range s.pending {
+		if entry.Did != did || entry.Invalid || entry.Nullified || entry.CreatedAt <= from || entry.CreatedAt >= to {
+			continue
+		}
+
+		if first == nil || entry.CreatedAt < first.CreatedAt {
+			first = entry
+		}
+	}
+
+	return first, nil
+}
+
+// isKnown returns whether an entry has already been stored or added to the page. Known entries are
+// left as they are, including their nullified flag, which only nullifyForkedOps sets.
+func (s *entryStore) isKnown(cid string) (bool, error) {
+	if _, ok := s.byCid[cid]; ok {
+		return true, nil
+	}
+
+	if entry, ok := s.stored[cid]; ok {
+		return entry != nil, nil
+	}
+
+	var exists bool
+	if err := s.db.Raw("SELECT EXISTS (SELECT 1 FROM plc_entries WHERE cid = ?)", cid).Scan(&exists).Error; err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// nullifyForkedOps marks every operation between the prev of a recovery operation and the recovery
+// operation itself as nullified, leaving the recovery operation as the new head of the did's chain.
+// For an entry that follows the current head this is a no-op.
+func (s *entryStore) nullifyForkedOps(entry *PlcEntry) error {
+	prev := entry.Operation.Prev()
+	if prev == nil {
+		return nil
+	}
+
+	prevEntry, err := s.getEntry(entry.Did, *prev)
+	if err != nil {
+		return err
+	}
+
+	if prevEntry == nil || s.noneAfter(entry.Did, prevEntry.CreatedAt) {
+		return nil
+	}
+
+	if _, ok := s.latest[entry.Did]; ok {
+		s.latest[entry.Did] = entry
+	}
+
+	for _, pending := range s.pending {
+		if pending.Did == entry.Did && pending.Cid != entry.Cid && pending.CreatedAt > prevEntry.CreatedAt && pending.CreatedAt < entry.CreatedAt {
+			pending.Nullified = true
+		}
+	}
+
+	// operations after the recovery operation are only stored when verifying entries that we already
+	// have, and they follow the recovery operation rather than being nullified by it
+	return s.db.Exec("UPDATE plc_entries SET nullified = true WHERE did = ? AND cid <> ? AND NOT nullified AND created_at > ? AND created_at < ?", entry.Did, entry.Cid, prevEntry.CreatedAt, entry.CreatedAt).Error
+}
+
+// heads returns the last valid, non-nullified pending entry of each did, in page order
+func (s *entryStore) heads() []*PlcEntry {
+	idx := map[string]int{}
+	var heads []*PlcEntry
+	for _, entry := range s.pending {
+		if entry.Invalid || entry.Nullified {
+			continue
+		}
+
+		if i, ok := idx[entry.Did]; ok {
+			heads[i] = entry
+			continue
+		}
+
+		idx[entry.Did] = len(heads)
+		heads = append(heads, entry)
+	}
+
+	return heads
+}
@@ -0,0 +1,743 @@
+package mirage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+)
+
+// memUpstream serves export pages from a list of entries. fail is called before each page is
+// returned, and the page fails with its error if it returns one.
+type memUpstream struct {
+	lk      sync.Mutex
+	entries []*PlcEntry
+	calls   []string
+	fail    func(after string) error
+}
+
+func (u *memUpstream) Export(ctx context.Context, after string, count int) ([]byte, error) {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+
+	u.calls = append(u.calls, after)
+
+	if u.fail != nil {
+		if err := u.fail(after); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	n := 0
+	for _, entry := range u.entries {
+		if entry.CreatedAt <= after {
+			continue
+		}
+
+		if n == count {
+			break
+		}
+
+		b, err := marshalJSONNoEscape(entry)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+		n++
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (u *memUpstream) getCalls() []string {
+	u.lk.Lock()
+	defer u.lk.Unlock()
+	return append([]string{}, u.calls...)
+}
+
+// testIdentity signs a chain of operations for a single did
+type testIdentity struct {
+	key  *crypto.PrivateKeyK256
+	did  string
+	head *PlcEntry
+}
+
+// newTestIdentity creates a did with a signed genesis operation that claims the given handles
+func newTestIdentity(t *testing.T, createdAt time.Time, handles ...string) (*testIdentity, *PlcEntry) {
+	t.Helper()
+
+	key, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	id := &testIdentity{key: key}
+	entry := id.sign(t, nil, createdAt, handles)
+
+	did, err := entry.Operation.GenesisDid()
+	if err != nil {
+		t.Fatalf("failed to compute did: %v", err)
+	}
+	id.did = did
+	entry.Did = did
+
+	return id, entry
+}
+
+// update signs an operation that follows the identity's last operation
+func (id *testIdentity) update(t *testing.T, createdAt time.Time, handles ...string) *PlcEntry {
+	t.Helper()
+
+	prev := id.head.Cid
+	return id.sign(t, &prev, createdAt, handles)
+}
+
+func (id *testIdentity) sign(t *testing.T, prev *string, createdAt time.Time, handles []string) *PlcEntry {
+	t.Helper()
+
+	pub, err := id.key.PublicKey()
+	if err != nil {
+		t.Fatalf("failed to get public key: %v", err)
+	}
+
+	aka := []string{}
+	for _, handle := range handles {
+		aka = append(aka, "at://"+handle)
+	}
+
+	op := PlcOperationType{PlcOperation: &PlcOperation{
+		Prev: prev,
+		Type: "plc_operation",
+		Services: map[string]PlcService{
+			atprotoPdsService: {Type: atprotoPdsServiceType, Endpoint: "https://pds.test"},
+		},
+		AlsoKnownAs:         aka,
+		RotationKeys:        []string{pub.DIDKey()},
+		VerificationMethods: map[string]string{atprotoVerificationMethod: pub.DIDKey()},
+	}}
+
+	unsigned, err := op.UnsignedBytes()
+	if err != nil {
+		t.Fatalf("failed to encode operation: %v", err)
+	}
+
+	sig, err := id.key.HashAndSign(unsigned)
+	if err != nil {
+		t.Fatalf("failed to sign operation: %v", err)
+	}
+	op.PlcOperation.Sig = base64.RawURLEncoding.EncodeToString(sig)
+
+	c, err := op.Cid()
+	if err != nil {
+		t.Fatalf("failed to compute cid: %v", err)
+	}
+
+	entry := &PlcEntry{
+		Did:       id.did,
+		Operation: op,
+		Cid:       c.String(),
+		CreatedAt: createdAt.UTC().Format(createdAtFormat),
+	}
+	id.head = entry
+
+	return entry
+}
+
+func TestExportWait(t *testing.T) {
+	m := &Mirage{
+		pollInterval:    time.Second,
+		catchUpInterval: time.Millisecond,
+	}
+
+	tests := []struct {
+		name   string
+		after  string
+		expect time.Duration
+	}{
+		{"no cursor", "", m.pollInterval},
+		{"caught up", time.Now().Add(-time.Minute).UTC().Format(createdAtFormat), m.pollInterval},
+		{"behind", time.Now().Add(-2 * catchUpThreshold).UTC().Format(createdAtFormat), m.catchUpInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if wait := m.exportWait(tt.after); wait != tt.expect {
+				t.Fatalf("expected %s, got %s", tt.expect, wait)
+			}
+		})
+	}
+}
+
+// waitForCursor waits for the exporter to commit the given cursor
+func waitForCursor(t *testing.T, m *Mirage, cursor string) *SyncState {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		state, err := m.GetSyncState()
+		if err != nil {
+			t.Fatalf("failed to get sync state: %v", err)
+		}
+
+		if state != nil && state.Cursor == cursor {
+			return state
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for cursor %s", cursor)
+	return nil
+}
+
+func TestRunExporter(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+
+	upstream := &memUpstream{}
+	for i := range 3 {
+		_, entry := newTestIdentity(t, start.Add(time.Duration(i)*time.Second), fmt.Sprintf("user%d.test", i))
+		upstream.entries = append(upstream.entries, entry)
+	}
+
+	m, _ := newTestMirage(t, upstream)
+	m.pollInterval = time.Millisecond
+	m.catchUpInterval = time.Millisecond
+	m.pageSize = 2
+
+	m.RunExporter()
+
+	last := upstream.entries[len(upstream.entries)-1]
+	state := waitForCursor(t, m, last.CreatedAt)
+
+	if state.LastCid != last.Cid {
+		t.Fatalf("expected last cid %s, got %s", last.Cid, state.LastCid)
+	}
+
+	if state.Entries != 3 || state.InvalidEntries != 0 || state.Pages != 2 {
+		t.Fatalf("unexpected sync state: %+v", state)
+	}
+
+	calls := upstream.getCalls()
+	if len(calls) < 2 || calls[0] != "" || calls[1] != upstream.entries[1].CreatedAt {
+		t.Fatalf("unexpected export calls: %v", calls)
+	}
+}
+
+func TestRunExporterResumesFromCursor(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+
+	upstream := &memUpstream{}
+	for i := range 2 {
+		_, entry := newTestIdentity(t, start.Add(time.Duration(i)*time.Second), fmt.Sprintf("user%d.test", i))
+		upstream.entries = append(upstream.entries, entry)
+	}
+
+	m, _ := newTestMirage(t, upstream)
+	m.pollInterval = time.Millisecond
+
+	if err := updateSyncState(m.db.c, &SyncState{Cursor: upstream.entries[0].CreatedAt}); err != nil {
+		t.Fatalf("failed to set cursor: %v", err)
+	}
+
+	m.RunExporter()
+
+	waitForCursor(t, m, upstream.entries[1].CreatedAt)
+
+	if calls := upstream.getCalls(); calls[0] != upstream.entries[0].CreatedAt {
+		t.Fatalf("expected the first export to resume from the cursor, got %v", calls)
+	}
+
+	var count int64
+	if err := m.db.c.Model(&PlcEntry{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count entries: %v", err)
+	}
+
+	if count != 1 {
+		t.Fatalf("expected only the entry after the cursor to be ingested, got %d", count)
+	}
+}
+
+func TestRunExporterRetriesFailedPage(t *testing.T) {
+	_, entry := newTestIdentity(t, time.Now().Add(-time.Minute), "user.test")
+
+	failures := 0
+	upstream := &memUpstream{
+		entries: []*PlcEntry{entry},
+		fail: func(after string) error {
+			if failures < 2 {
+				failures++
+				return context.DeadlineExceeded
+			}
+			return nil
+		},
+	}
+
+	m, _ := newTestMirage(t, upstream)
+	m.pollInterval = time.Millisecond
+
+	m.RunExporter()
+
+	waitForCursor(t, m, entry.CreatedAt)
+
+	calls := upstream.getCalls()
+	if len(calls) < 3 || calls[0] != "" || calls[1] != "" || calls[2] != "" {
+		t.Fatalf("expected the failed page to be requested again, got %v", calls)
+	}
+}
+
+func TestIngestPageRollsBackFailedPage(t *testing.T) {
+	_, entry := newTestIdentity(t, time.Now().Add(-time.Minute), "user.test")
+	upstream := &memUpstream{entries: []*PlcEntry{entry}}
+
+	m, _ := newTestMirage(t, upstream)
+
+	page, err := upstream.Export(context.Background(), "", defaultPageSize)
+	if err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+
+	// make the end of the page fail, after the entries have been written
+	if err := m.db.c.Exec("ALTER TABLE sync_state RENAME TO sync_state_hidden").Error; err != nil {
+		t.Fatalf("failed to hide sync state: %v", err)
+	}
+
+	cursor, err := m.ingestPage(page, "")
+	if err == nil {
+		t.Fatal("expected the page to fail")
+	}
+
+	if cursor != "" {
+		t.Fatalf("expected the cursor to stay put, got %s", cursor)
+	}
+
+	var count int64
+	if err := m.db.c.Model(&PlcEntry{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count entries: %v", err)
+	}
+
+	if count != 0 {
+		t.Fatalf("expected nothing to be committed, got %d entries", count)
+	}
+
+	if err := m.db.c.Exec("ALTER TABLE sync_state_hidden RENAME TO sync_state").Error; err != nil {
+		t.Fatalf("failed to restore sync state: %v", err)
+	}
+
+	cursor, err = m.ingestPage(page, "")
+	if err != nil {
+		t.Fatalf("failed to ingest page: %v", err)
+	}
+
+	if cursor != entry.CreatedAt {
+		t.Fatalf("expected cursor %s, got %s", entry.CreatedAt, cursor)
+	}
+}
+
+func TestVerifyEntryCreatedAt(t *testing.T) {
+	_, entry := newTestIdentity(t, time.Now(), "user.test")
+
+	store := &entryStore{byCid: map[string]*PlcEntry{}}
+	if err := store.verifyEntry(entry); err != nil {
+		t.Fatalf("expected a valid entry, got %v", err)
+	}
+
+	entry.CreatedAt = "not a time"
+	if err := store.verifyEntry(entry); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected an invalid operation, got %v", err)
+	}
+}
+
+// TestEntryStorePreloaded checks that a preloaded page is ingested without going to the db. The
+// store has no db, so any query would panic.
+func TestEntryStorePreloaded(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+
+	id, genesis := newTestIdentity(t, start, "user.test")
+	first := id.update(t, start.Add(time.Second), "first.test")
+	second := id.update(t, start.Add(2*time.Second), "second.test")
+	_, other := newTestIdentity(t, start.Add(3*time.Second), "other.test")
+
+	m := &Mirage{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	store := &entryStore{
+		byCid:  map[string]*PlcEntry{},
+		stored: map[string]*PlcEntry{genesis.Cid: genesis, first.Cid: nil, second.Cid: nil, other.Cid: nil},
+		latest: map[string]*PlcEntry{id.did: genesis, other.Did: nil},
+	}
+
+	for _, entry := range []*PlcEntry{genesis, first, second, other} {
+		if err := m.ingestEntry(store, entry); err != nil {
+			t.Fatalf("failed to ingest %s: %v", entry.Cid, err)
+		}
+	}
+
+	// the genesis was already stored, so only the rest are pending
+	if len(store.pending) != 3 {
+		t.Fatalf("expected 3 pending entries, got %d", len(store.pending))
+	}
+
+	for _, entry := range store.pending {
+		if entry.Invalid || entry.Nullified {
+			t.Fatalf("expected %s to be valid and not nullified: %s", entry.Cid, entry.InvalidReason)
+		}
+	}
+
+	if store.latest[id.did] != second || store.latest[other.Did] != other {
+		t.Fatal("expected the latest entries to follow the pending entries")
+	}
+}
+
+func TestIngestPageInvalidCreatedAt(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+
+	_, good := newTestIdentity(t, start, "good.test")
+	_, bad := newTestIdentity(t, start.Add(time.Second), "bad.test")
+	bad.CreatedAt = "yesterday"
+
+	upstream := &memUpstream{entries: []*PlcEntry{good, bad}}
+	m, _ := newTestMirage(t, upstream)
+
+	cursor, err := m.ingestPage(pageOf(t, upstream.entries...), "")
+	if err != nil {
+		t.Fatalf("failed to ingest page: %v", err)
+	}
+
+	if cursor != good.CreatedAt {
+		t.Fatalf("expected cursor %s, got %s", good.CreatedAt, cursor)
+	}
+
+	var stored PlcEntry
+	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE cid = ?", bad.Cid).Scan(&stored).Error; err != nil {
+		t.Fatalf("failed to get entry: %v", err)
+	}
+
+	if !stored.Invalid {
+		t.Fatal("expected the entry to be flagged invalid")
+	}
+
+	var handles int64
+	if err := m.db.c.Model(&DidHandle{}).Where("did = ?", bad.Did).Count(&handles).Error; err != nil {
+		t.Fatalf("failed to count did handles: %v", err)
+	}
+
+	if handles != 0 {
+		t.Fatal("expected no did handle for the invalid entry")
+	}
+}
+
+// pageOf encodes entries the way the upstream export does
+func pageOf(t *testing.T, entries ...*PlcEntry) []byte {
+	t.Helper()
+
+	var page bytes.Buffer
+	for _, entry := range entries {
+		b, err := marshalJSONNoEscape(entry)
+		if err != nil {
+			t.Fatalf("failed to marshal entry: %v", err)
+		}
+		page.Write(b)
+		page.WriteByte('\n')
+	}
+
+	return page.Bytes()
+}
+
+// TestIngestHandleChange covers operations for a did whose handle is already cached, which used to
+// be skipped entirely
+func TestIngestHandleChange(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+
+	id, genesis := newTestIdentity(t, start, "old.test")
+	update := id.update(t, start.Add(time.Second), "new.test")
+
+	m, mr := newTestMirage(t, nil)
+
+	cursor, err := m.ingestPage(pageOf(t, genesis), "")
+	if err != nil {
+		t.Fatalf("failed to ingest genesis: %v", err)
+	}
+
+	if handle, _ := mr.Get(redisPrefix + didHandlePrefix + id.did); handle != "old.test" {
+		t.Fatalf("expected the genesis handle to be cached, got %q", handle)
+	}
+
+	page := pageOf(t, update)
+
+	cursor, err = m.ingestPage(page, cursor)
+	if err != nil {
+		t.Fatalf("failed to ingest update: %v", err)
+	}
+
+	if cursor != update.CreatedAt {
+		t.Fatalf("expected cursor %s, got %s", update.CreatedAt, cursor)
+	}
+
+	assertMoved := func(t *testing.T) {
+		t.Helper()
+
+		var entries []PlcEntry
+		if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE did = ? ORDER BY created_at", id.did).Scan(&entries).Error; err != nil {
+			t.Fatalf("failed to get entries: %v", err)
+		}
+
+		if len(entries) != 2 || entries[0].Cid != genesis.Cid || entries[1].Cid != update.Cid {
+			t.Fatalf("expected the genesis and update to be stored, got %d entries", len(entries))
+		}
+
+		for _, entry := range entries {
+			if entry.Invalid || entry.Nullified {
+				t.Fatalf("expected %s to be valid and not nullified", entry.Cid)
+			}
+		}
+
+		var dh DidHandle
+		if err := m.db.c.Raw("SELECT * FROM did_handles WHERE did = ?", id.did).Scan(&dh).Error; err != nil {
+			t.Fatalf("failed to get did handle: %v", err)
+		}
+
+		if dh.Handle != "new.test" || dh.Tombstoned {
+			t.Fatalf("expected did_handles to move to new.test, got %+v", dh)
+		}
+
+		var aliases []DidAlias
+		if err := m.db.c.Raw("SELECT * FROM did_aliases WHERE did = ? ORDER BY position", id.did).Scan(&aliases).Error; err != nil {
+			t.Fatalf("failed to get did aliases: %v", err)
+		}
+
+		if len(aliases) != 1 || aliases[0].Handle != "new.test" {
+			t.Fatalf("expected did_aliases to move to new.test, got %+v", aliases)
+		}
+
+		if handle, _ := mr.Get(redisPrefix + didHandlePrefix + id.did); handle != "new.test" {
+			t.Fatalf("expected the cached handle to be new.test, got %q", handle)
+		}
+
+		if did, _ := mr.Get(redisPrefix + handleDidPrefix + "new.test"); did != id.did {
+			t.Fatalf("expected new.test to be cached for the did, got %q", did)
+		}
+
+		if mr.Exists(redisPrefix + handleDidPrefix + "old.test") {
+			t.Fatal("expected old.test to be uncached")
+		}
+	}
+
+	assertMoved(t)
+
+	// replaying the page is a no-op, since the cid is already stored
+	if _, err := m.ingestPage(page, genesis.CreatedAt); err != nil {
+		t.Fatalf("failed to replay update: %v", err)
+	}
+
+	assertMoved(t)
+
+	state, err := m.GetSyncState()
+	if err != nil {
+		t.Fatalf("failed to get sync state: %v", err)
+	}
+
+	if state.Entries != 2 {
+		t.Fatalf("expected the replay not to store anything, got %d entries", state.Entries)
+	}
+}
+
+func TestIngestAliasHistory(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+
+	id, genesis := newTestIdentity(t, start, "main.test", "old-alias.test")
+	update := id.update(t, start.Add(time.Second), "main.test", "new-alias.test")
+
+	m, _ := newTestMirage(t, nil)
+
+	if _, err := m.ingestPage(pageOf(t, genesis, update), ""); err != nil {
+		t.Fatalf("failed to ingest page: %v", err)
+	}
+
+	hhs, err := m.GetHandleHistory(id.did)
+	if err != nil {
+		t.Fatalf("failed to get handle history: %v", err)
+	}
+
+	type change struct {
+		handle, prevHandle, cid string
+		isPrimary               bool
+	}
+
+	expected := []change{
+		{"main.test", "", genesis.Cid, true},
+		{"old-alias.test", "", genesis.Cid, false},
+		{"new-alias.test", "", update.Cid, false},
+		{"", "old-alias.test", update.Cid, false},
+	}
+
+	if len(hhs) != len(expected) {
+		t.Fatalf("expected %d changes, got %+v", len(expected), hhs)
+	}
+
+	for i, hh := range hhs {
+		if got := (change{hh.Handle, hh.PrevHandle, hh.Cid, hh.IsPrimary}); got != expected[i] {
+			t.Fatalf("expected change %d to be %+v, got %+v", i, expected[i], got)
+		}
+	}
+
+	claims, err := m.GetHandleClaims("old-alias.test")
+	if err != nil {
+		t.Fatalf("failed to get handle claims: %v", err)
+	}
+
+	if len(claims) != 1 || claims[0].IsPrimary || claims[0].Cid != genesis.Cid || claims[0].ReleasedCid == nil || *claims[0].ReleasedCid != update.Cid {
+		t.Fatalf("expected a single released secondary claim, got %+v", claims)
+	}
+
+	claims, err = m.GetHandleClaims("main.test")
+	if err != nil {
+		t.Fatalf("failed to get handle claims: %v", err)
+	}
+
+	if len(claims) != 1 || !claims[0].IsPrimary || claims[0].ReleasedAt != nil {
+		t.Fatalf("expected a single current primary claim, got %+v", claims)
+	}
+}
+
+func TestIngestInvalidatesDroppedHandles(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+
+	id, genesis := newTestIdentity(t, start, "main.test", "alias.test")
+	update := id.update(t, start.Add(time.Second), "main.test")
+
+	m, _ := newTestMirage(t, nil)
+	m.local = newLocalCache(0, 0)
+	m.resolver = newTestResolver(t, map[string][]string{"_atproto.alias.test": {"did=" + id.did}}, nil)
+
+	cursor, err := m.ingestPage(pageOf(t, genesis), "")
+	if err != nil {
+		t.Fatalf("failed to ingest genesis: %v", err)
+	}
+
+	did, found, err := m.GetDidFromHandle("alias.test")
+	if err != nil || !found || *did != id.did {
+		t.Fatalf("expected alias.test to resolve to the did, got %v %v", found, err)
+	}
+
+	if _, ok := localGet[string](m, handleDidPrefix+"alias.test"); !ok {
+		t.Fatal("expected alias.test to be cached locally")
+	}
+
+	if _, err := m.ingestPage(pageOf(t, update), cursor); err != nil {
+		t.Fatalf("failed to ingest update: %v", err)
+	}
+
+	if _, ok := localGet[string](m, handleDidPrefix+"alias.test"); ok {
+		t.Fatal("expected alias.test to be dropped from the local cache")
+	}
+
+	if _, found, err := m.GetDidFromHandle("alias.test"); err != nil || found {
+		t.Fatalf("expected alias.test to no longer resolve, got %v %v", found, err)
+	}
+}
+
+func TestGetDidFromHandleAliasClaims(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+
+	first, firstGenesis := newTestIdentity(t, start, "first.test", "shared.test")
+	second, secondGenesis := newTestIdentity(t, start.Add(time.Second), "second.test", "shared.test")
+	_, other := newTestIdentity(t, start.Add(2*time.Second), "other.test")
+
+	m, _ := newTestMirage(t, nil)
+	m.local = newLocalCache(0, 0)
+
+	if _, err := m.ingestPage(pageOf(t, firstGenesis, secondGenesis, other), ""); err != nil {
+		t.Fatalf("failed to ingest page: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		txt    map[string][]string
+		did    string
+		found  bool
+		cached bool
+	}{
+		{"resolves to the later claim", map[string][]string{"_atproto.shared.test": {"did=" + second.did}}, second.did, true, true},
+		{"resolves to a did that doesn't list it", map[string][]string{"_atproto.shared.test": {"did=" + other.Did}}, "", false, false},
+		{"doesn't resolve", nil, first.did, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.local.Purge()
+			m.resolver = newTestResolver(t, tt.txt, nil)
+
+			did, found, err := m.GetDidFromHandle("shared.test")
+			if err != nil {
+				t.Fatalf("failed to get did: %v", err)
+			}
+
+			if found != tt.found || (found && *did != tt.did) {
+				t.Fatalf("expected %v %s, got %v %v", tt.found, tt.did, found, did)
+			}
+
+			if _, ok := localGet[string](m, handleDidPrefix+"shared.test"); ok != tt.cached {
+				t.Fatalf("expected cached to be %v", tt.cached)
+			}
+		})
+	}
+}
+
+func TestIngestIgnoresUpstreamNullified(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+
+	id, genesis := newTestIdentity(t, start, "user.test")
+	update := id.update(t, start.Add(time.Second), "new.test")
+
+	m, _ := newTestMirage(t, nil)
+
+	// nothing nullifies the update, so the upstream's flag is ignored
+	update.Nullified = true
+
+	cursor, err := m.ingestPage(pageOf(t, genesis, update), "")
+	if err != nil {
+		t.Fatalf("failed to ingest page: %v", err)
+	}
+
+	getNullified := func(t *testing.T, cid string) bool {
+		t.Helper()
+
+		var nullified []bool
+		if err := m.db.c.Raw("SELECT nullified FROM plc_entries WHERE cid = ?", cid).Scan(&nullified).Error; err != nil {
+			t.Fatalf("failed to get entry: %v", err)
+		}
+
+		if len(nullified) != 1 {
+			t.Fatalf("expected %s to be stored", cid)
+		}
+
+		return nullified[0]
+	}
+
+	if getNullified(t, update.Cid) {
+		t.Fatal("expected the update not to be nullified")
+	}
+
+	// and a stored flag is never cleared by the upstream either
+	if err := m.db.c.Exec("UPDATE plc_entries SET nullified = true WHERE cid = ?", genesis.Cid).Error; err != nil {
+		t.Fatalf("failed to nullify genesis: %v", err)
+	}
+
+	update.Nullified = false
+	if _, err := m.ingestPage(pageOf(t, genesis, update), cursor); err != nil {
+		t.Fatalf("failed to replay page: %v", err)
+	}
+
+	if !getNullified(t, genesis.Cid) || getNullified(t, update.Cid) {
+		t.Fatal("expected the stored nullified flags to be left alone")
+	}
+}
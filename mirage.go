@@ -2,41 +2,55 @@ package mirage
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
-	"net"
 	"net/http"
 	"os"
-	"strings"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/go-redis/redis"
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/labstack/echo/v4"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 )
 
 type Mirage struct {
-	client *http.Client
+	client   *http.Client
+	upstream Upstream
+
+	pollInterval    time.Duration
+	catchUpInterval time.Duration
+	pageSize        int
+	verifyHandles   bool
+
+	resolver *HandleResolver
+
 	server *http.Server
 	echo   *echo.Echo
 	r      *redis.Client
 	db     *MirageDb
 	logger *slog.Logger
-	ctx    context.Context
-	wg     sync.WaitGroup
+
+	// local is an in-process cache in front of redis, or nil if it is disabled
+	local *expirable.LRU[string, any]
+
+	// entries receives every valid entry once the exporter has committed it
+	entries *broker[*PlcEntry]
+	// handleEvents receives every change to did_handles once the exporter has committed it
+	handleEvents *broker[*HandleEvent]
+
+	ctx context.Context
+	wg  sync.WaitGroup
 }
 
 type MirageDb struct {
-	c  *gorm.DB
-	mu sync.Mutex
+	c *gorm.DB
 }
 
 type MirageArgs struct {
@@ -47,10 +61,29 @@ type MirageArgs struct {
 	PostgresPass string
 	RedisHost    string
 	LogLevel     string
+	// Upstream is where operations are exported from. See NewUpstream for the supported values.
+	Upstream string
+	// PollInterval is the wait between export pages once ingestion has caught up
+	PollInterval time.Duration
+	// CatchUpInterval is the wait between export pages while ingestion is far behind
+	CatchUpInterval time.Duration
+	// PageSize is the number of entries requested per export page. It may not exceed the largest count
+	// /export accepts, since the upstream may be another mirage.
+	PageSize int
+	// VerifyHandles enables verifying handles in the background as the exporter changes them
+	VerifyHandles bool
+	// HandleResolver is used to resolve handles. NewHandleResolver is used if it is nil.
+	HandleResolver *HandleResolver
+	// LocalCacheSize is the number of entries kept in the in-process cache. A negative size disables it.
+	LocalCacheSize int
+	// LocalCacheTTL is how long entries are kept in the in-process cache
+	LocalCacheTTL time.Duration
 }
 
 type MirageServerArgs struct {
 	ServerPort string
+	// AdminToken is the bearer token for the /admin api. The api is disabled when it is empty.
+	AdminToken string
 }
 
 var (
@@ -65,14 +98,28 @@ var (
 	didHandlePrefix = "did_handle/"
 	handleDidPrefix = "handle_did/"
 
-	plcRoot     = "https://plc.directory"
+	defaultUpstream = "https://plc.directory"
+	createdAtFormat = "2006-01-02T15:04:05.000Z"
+
+	exportDefaultCount = 10
+	exportMaxCount     = 1000
+
 	respContext = []string{
 		"https://www.w3.org/ns/did/v1",
 		"https://w3id.org/security/multikey/v1",
 	}
 )
 
+var (
+	ErrDidNotFound   = errors.New("did not found")
+	ErrDidTombstoned = errors.New("did has been tombstoned")
+)
+
 func NewMirage(ctx context.Context, args *MirageArgs) (*Mirage, error) {
+	if args.PageSize < 0 || args.PageSize > exportMaxCount {
+		return nil, fmt.Errorf("page size must be between 1 and %d", exportMaxCount)
+	}
+
 	ll := slog.LevelInfo
 	switch args.LogLevel {
 	case "debug":
@@ -95,62 +142,92 @@ func NewMirage(ctx context.Context, args *MirageArgs) (*Mirage, error) {
 	}
 
 	logger.Info("migrating...")
-	db.AutoMigrate(&PlcEntry{})
-	db.AutoMigrate(&DidHandle{})
+	if err := migrate(db); err != nil {
+		logger.Error("failed to migrate", "err", err)
+	}
+
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+	}
+
+	upstream, err := NewUpstream(args.Upstream, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream: %w", err)
+	}
+
+	resolver := args.HandleResolver
+	if resolver == nil {
+		resolver = NewHandleResolver()
+	}
+
+	pollInterval := args.PollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+
+	catchUpInterval := args.CatchUpInterval
+	if catchUpInterval == 0 {
+		catchUpInterval = defaultCatchUpInterval
+	}
+
+	pageSize := args.PageSize
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
 
 	return &Mirage{
-		client: &http.Client{
-			Timeout: 2 * time.Second,
-		},
+		client:          client,
+		upstream:        upstream,
+		pollInterval:    pollInterval,
+		catchUpInterval: catchUpInterval,
+		pageSize:        pageSize,
+		verifyHandles:   args.VerifyHandles,
+		resolver:        resolver,
+		local:           newLocalCache(args.LocalCacheSize, args.LocalCacheTTL),
 		db: &MirageDb{
-			c:  db,
-			mu: sync.Mutex{},
+			c: db,
 		},
 		r: redis.NewClient(&redis.Options{
 			Addr: args.RedisHost,
 		}),
-		logger: logger,
-		ctx:    ctx,
-		wg:     sync.WaitGroup{},
+		logger:       logger,
+		entries:      newBroker[*PlcEntry](),
+		handleEvents: newBroker[*HandleEvent](),
+		ctx:          ctx,
+		wg:           sync.WaitGroup{},
 	}, nil
 }
 
-func (m *Mirage) RunServer(args *MirageServerArgs) {
-	m.echo = echo.New()
-	m.echo.GET("/handle/:did", m.handleGetHandleFromDid)
-	m.echo.GET("/did/:handle", m.handleGetDidFromHandle)
-
-	dorhMw := func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(e echo.Context) error {
-			didOrHandle := e.Param("didOrHandle")
-			did, found, err := m.getDidFromDidOrHandle(didOrHandle)
-			if err != nil {
-				return e.JSON(500, map[string]string{"error": err.Error()})
-			}
-
-			if !found {
-				return e.JSON(404, map[string]string{"error": "did not found"})
-			}
-
-			e.SetParamValues(*did)
-
-			if err := next(e); err != nil {
-				e.Error(err)
-			}
+// migrate migrates every table, carrying on past failures so that one bad table doesn't stop the
+// others from being migrated
+func migrate(db *gorm.DB) error {
+	var errs []error
+	for _, model := range []any{
+		&PlcEntry{},
+		&DidHandle{},
+		&DidAlias{},
+		&SyncState{},
+		&HandleHistory{},
+		&Webhook{},
+		&WebhookDelivery{},
+	} {
+		if err := db.AutoMigrate(model); err != nil {
+			errs = append(errs, err)
+		}
+	}
 
-			return nil
+	// handle_history used to have a single row per operation
+	if db.Migrator().HasIndex(&HandleHistory{}, "idx_handle_history_cid") {
+		if err := db.Migrator().DropIndex(&HandleHistory{}, "idx_handle_history_cid"); err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	m.echo.GET("/service/:didOrHandle", m.handleGetService, dorhMw)
-	m.echo.GET("/created/:didOrHandle", m.handleGetCreatedAt, dorhMw)
-	m.echo.GET("/:didOrHandle", m.handleResolveDid, dorhMw)
-	m.echo.GET("/:didOrHandle/log", m.handleGetPlcOpLog, dorhMw)
-	m.echo.GET("/:didOrHandle/log/audit", m.handleGetAuditLog, dorhMw)
-	m.echo.GET("/:didOrHandle/log/last", m.handleGetLastOp, dorhMw)
-	m.echo.GET("/:didOrHandle/data", m.handleGetPlcData, dorhMw)
-	m.echo.GET("/users", m.handleGetDidHandles)
-	m.echo.GET("/export", m.handleExport, dorhMw)
+	return errors.Join(errs...)
+}
+
+func (m *Mirage) RunServer(args *MirageServerArgs) {
+	m.echo = m.newRouter(args)
 
 	m.server = &http.Server{
 		Addr:    ":" + args.ServerPort,
@@ -165,7 +242,12 @@ func (m *Mirage) RunServer(args *MirageServerArgs) {
 	}()
 
 	m.logger.Info("starting exporter")
-	m.runExporter(args)
+	m.RunExporter()
+
+	m.runLocalInvalidation()
+
+	m.logger.Info("starting webhook deliveries")
+	m.RunWebhookDeliveries()
 
 	<-m.ctx.Done()
 
@@ -175,107 +257,159 @@ func (m *Mirage) RunServer(args *MirageServerArgs) {
 	m.wg.Wait()
 }
 
-func (m *Mirage) ResolveHandle(handle string) (*string, error) {
-	res, err := net.LookupTXT("_atproto." + handle)
-	if err == nil {
-		for _, r := range res {
-			if strings.HasPrefix(r, "did=") {
-				return &r, nil
+// newRouter registers every route that RunServer serves
+func (m *Mirage) newRouter(args *MirageServerArgs) *echo.Echo {
+	e := echo.New()
+	e.GET("/handle/:did", m.handleGetHandleFromDid)
+	e.GET("/did/:handle", m.handleGetDidFromHandle)
+	e.GET("/resolveHandle", m.handleResolveHandle)
+	e.GET("/debug/vars", m.handleCacheMetrics)
+
+	dorhMw := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(e echo.Context) error {
+			at, err := parseAt(e)
+			if err != nil {
+				return e.JSON(http.StatusBadRequest, createError("invalid at, expected an RFC3339 timestamp"))
 			}
-		}
-	}
 
-	req, err := http.NewRequest("GET", "https://"+handle+"/.well-known/atproto-did", nil)
-	if err != nil {
-		return nil, err
-	}
+			didOrHandle := e.Param("didOrHandle")
+			did, found, err := m.getDidFromDidOrHandle(didOrHandle, at)
+			if err != nil {
+				return e.JSON(500, createError(err.Error()))
+			}
 
-	resp, err := m.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
+			if !found {
+				return e.JSON(404, createError(ErrDidNotFound.Error()))
+			}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("non-200 status code")
-	}
+			e.SetParamValues(*did)
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+			if err := next(e); err != nil {
+				e.Error(err)
+			}
 
-	mbDid := string(b)
-	if _, err := syntax.ParseDID(mbDid); err != nil {
-		return nil, err
+			return nil
+		}
 	}
 
-	return &mbDid, nil
+	e.GET("/service/:didOrHandle", m.handleGetService, dorhMw)
+	e.GET("/created/:didOrHandle", m.handleGetCreatedAt, dorhMw)
+	e.GET("/:didOrHandle", m.handleResolveDid, dorhMw)
+	e.GET("/:didOrHandle/log", m.handleGetPlcOpLog, dorhMw)
+	e.GET("/:didOrHandle/log/audit", m.handleGetAuditLog, dorhMw)
+	e.GET("/:didOrHandle/log/last", m.handleGetLastOp, dorhMw)
+	e.GET("/:didOrHandle/data", m.handleGetPlcData, dorhMw)
+	e.GET("/:didOrHandle/handles", m.handleGetHandleHistory, dorhMw)
+	e.GET("/handle-history/:handle", m.handleGetHandleClaims)
+	e.GET("/users", m.handleGetDidHandles)
+	e.GET("/export", m.handleExport)
+	e.GET("/export/stream", m.handleExportStream)
+	e.GET("/events/handles", m.handleHandleEvents)
+
+	if args.AdminToken != "" {
+		admin := e.Group("/admin", adminAuthMw(args.AdminToken))
+		admin.GET("/webhooks", m.handleListWebhooks)
+		admin.POST("/webhooks", m.handleCreateWebhook)
+		admin.DELETE("/webhooks/:id", m.handleDeleteWebhook)
+	}
+
+	return e
+}
+
+// Wait blocks until everything started by RunServer or RunExporter has stopped. Cancel the context
+// passed to NewMirage to stop them.
+func (m *Mirage) Wait() {
+	m.wg.Wait()
+}
 
+// ResolveHandle resolves a handle to a did through dns and https. See HandleResolver.Resolve.
+func (m *Mirage) ResolveHandle(ctx context.Context, handle string) (string, error) {
+	return m.resolver.Resolve(ctx, handle)
 }
 
-func (m *Mirage) getDidFromDidOrHandle(didOrHandle string) (*string, bool, error) {
+// getDidFromDidOrHandle returns the did itself, or the did that a handle points at. If at is set, a
+// handle is resolved to the did that claimed it at that time.
+func (m *Mirage) getDidFromDidOrHandle(didOrHandle string, at *time.Time) (*string, bool, error) {
 	if _, err := syntax.ParseDID(didOrHandle); err == nil {
 		return &didOrHandle, true, nil
 	}
 
-	handle, found, err := m.GetDidFromHandle(didOrHandle)
+	var did *string
+	var found bool
+	var err error
+	if at != nil {
+		did, found, err = m.GetDidFromHandleAt(didOrHandle, *at)
+	} else {
+		did, found, err = m.GetDidFromHandle(didOrHandle)
+	}
 	if err != nil {
 		return nil, false, err
 	}
 
 	if !found {
-		return nil, false, fmt.Errorf("did or handle not found")
+		return nil, false, nil
 	}
 
-	return handle, true, nil
+	return did, true, nil
 }
 
 func (m *Mirage) ResolveDid(did string) (*ResolveDidResponse, error) {
-	var entry PlcEntry
-	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE did = ? ORDER BY created_at DESC LIMIT 1", did).Scan(&entry).Error; err != nil {
+	res, err := cachedRender(m, docCacheKind, did, didDocFromEntry)
+	if err != nil {
 		return nil, fmt.Errorf("failed to resolve did: %w", err)
 	}
 
-	aka := []string{}
-	if entry.Operation.PlcOperation != nil {
-		aka = entry.Operation.PlcOperation.AlsoKnownAs
-	} else if entry.Operation.LegacyPlcOperation != nil {
-		aka = []string{entry.Operation.LegacyPlcOperation.Handle}
+	return res, nil
+}
+
+// ResolveDidAt builds the did document as it was at the given time, from the last operation that
+// was created at or before it
+func (m *Mirage) ResolveDidAt(did string, t time.Time) (*ResolveDidResponse, error) {
+	entry, err := m.GetLastOpAt(did, t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve did: %w", err)
+	}
+
+	return didDocFromEntry(entry)
+}
+
+func didDocFromEntry(entry *PlcEntry) (*ResolveDidResponse, error) {
+	op := entry.Operation.Normalized()
+	if op == nil {
+		return nil, ErrDidTombstoned
 	}
 
 	ctxt := respContext
 
 	vm := []DocVerificationMethod{}
-	if entry.Operation.PlcOperation != nil {
-		for kid, key := range entry.Operation.PlcOperation.VerificationMethods {
-			kac, err := formatKeyAndContext(key)
-			if err != nil {
-				return nil, fmt.Errorf("failed to format key and context: %w", err)
-			}
-
-			includes := false
-			for _, c := range ctxt {
-				if c == kac.Context {
-					includes = true
-					break
-				}
-			}
+	for kid, key := range op.VerificationMethods {
+		kac, err := formatKeyAndContext(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to format key and context: %w", err)
+		}
 
-			if !includes {
-				ctxt = append(ctxt, kac.Context)
+		includes := false
+		for _, c := range ctxt {
+			if c == kac.Context {
+				includes = true
+				break
 			}
+		}
 
-			vm = append(vm, DocVerificationMethod{
-				Id:                 fmt.Sprintf("%s#%s", entry.Did, kid),
-				Type:               kac.Type,
-				Controller:         entry.Did,
-				PublicKeyMultibase: kac.PublicKeyMultibase,
-			})
+		if !includes {
+			ctxt = append(ctxt, kac.Context)
 		}
+
+		vm = append(vm, DocVerificationMethod{
+			Id:                 fmt.Sprintf("%s#%s", entry.Did, kid),
+			Type:               kac.Type,
+			Controller:         entry.Did,
+			PublicKeyMultibase: kac.PublicKeyMultibase,
+		})
 	}
 
 	svcs := []DocService{}
-	for id, svc := range entry.Operation.PlcOperation.Services {
+	for id, svc := range op.Services {
 		svcs = append(svcs, DocService{
 			Id:              "#" + id,
 			Type:            svc.Type,
@@ -286,59 +420,108 @@ func (m *Mirage) ResolveDid(did string) (*ResolveDidResponse, error) {
 	return &ResolveDidResponse{
 		Context:            ctxt,
 		Id:                 entry.Did,
-		AlsoKnownAs:        aka,
+		AlsoKnownAs:        op.AlsoKnownAs,
 		VerificationMethod: vm,
 		Service:            svcs,
 	}, nil
 }
 
+// GetPlcOpLog returns the canonical chain of operations for a did, leaving out nullified operations
 func (m *Mirage) GetPlcOpLog(did string) ([]PlcEntry, error) {
 	var entries []PlcEntry
-	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE did = ? ORDER BY created_at ASC", did).Scan(&entries).Error; err != nil {
+	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE did = ? AND NOT invalid AND NOT nullified ORDER BY created_at ASC", did).Scan(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// GetAuditLog returns every operation for a did, including ones that have been nullified
+func (m *Mirage) GetAuditLog(did string) ([]PlcEntry, error) {
+	var entries []PlcEntry
+	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE did = ? AND NOT invalid ORDER BY created_at ASC", did).Scan(&entries).Error; err != nil {
 		return nil, err
 	}
 
 	return entries, nil
 }
 
+func (m *Mirage) GetExport(after string, count int) ([]PlcEntry, error) {
+	var entries []PlcEntry
+	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE created_at > ? AND NOT invalid ORDER BY created_at ASC, id ASC LIMIT ?", after, count).Scan(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// GetLastOp returns the head of the did's canonical chain, or ErrDidNotFound if we have no operations
+// for the did
 func (m *Mirage) GetLastOp(did string) (*PlcEntry, error) {
-	var entry PlcEntry
-	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE did = ? ORDER BY created_at DESC LIMIT 1", did).Scan(&entry).Error; err != nil {
+	var entries []PlcEntry
+	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE did = ? AND NOT invalid AND NOT nullified ORDER BY created_at DESC LIMIT 1", did).Scan(&entries).Error; err != nil {
 		return nil, err
 	}
 
-	return &entry, nil
+	if len(entries) == 0 {
+		return nil, ErrDidNotFound
+	}
+
+	return &entries[0], nil
 }
 
-func (m *Mirage) GetPlcData(did string) (*DataResponse, error) {
-	op, err := m.GetLastOp(did)
-	if err != nil {
+// GetLastOpAt returns the last non-nullified operation that was created at or before the given
+// time, or ErrDidNotFound if the did didn't exist yet
+func (m *Mirage) GetLastOpAt(did string, t time.Time) (*PlcEntry, error) {
+	var entries []PlcEntry
+	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE did = ? AND created_at <= ? AND NOT invalid AND NOT nullified ORDER BY created_at DESC LIMIT 1", did, t.UTC().Format(createdAtFormat)).Scan(&entries).Error; err != nil {
 		return nil, err
 	}
 
-	if op.Operation.PlcTombstone != nil {
-		return nil, nil
+	if len(entries) == 0 {
+		return nil, ErrDidNotFound
 	}
 
-	if op.Operation.PlcOperation != nil {
-		op := op.Operation.PlcOperation
-		return &DataResponse{
-			Did:                 did,
-			VerificationMethods: op.VerificationMethods,
-			RotationKeys:        op.RotationKeys,
-			AlsoKnownAs:         op.AlsoKnownAs,
-			Services:            op.Services,
-		}, nil
+	return &entries[0], nil
+}
+
+func (m *Mirage) GetPlcData(did string) (*DataResponse, error) {
+	return cachedRender(m, dataCacheKind, did, plcDataFromEntry)
+}
+
+// GetPlcDataAt is GetPlcData as of the given time
+func (m *Mirage) GetPlcDataAt(did string, t time.Time) (*DataResponse, error) {
+	op, err := m.GetLastOpAt(did, t)
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO figure out legacy ops later lol
+	return plcDataFromEntry(op)
+}
 
-	return nil, nil
+func plcDataFromEntry(op *PlcEntry) (*DataResponse, error) {
+	normalized := op.Operation.Normalized()
+	if normalized == nil {
+		return nil, ErrDidTombstoned
+	}
+
+	return &DataResponse{
+		Did:                 op.Did,
+		VerificationMethods: normalized.VerificationMethods,
+		RotationKeys:        normalized.RotationKeys,
+		AlsoKnownAs:         normalized.AlsoKnownAs,
+		Services:            normalized.Services,
+	}, nil
 }
 
 func (m *Mirage) GetHandleFromDid(did string) (*string, bool, error) {
+	if handle, ok := localGet[string](m, didHandlePrefix+did); ok {
+		return &handle, true, nil
+	}
+
 	cached, err := m.r.Get(redisPrefix + didHandlePrefix + did).Result()
 	if err == nil {
+		m.localAdd(didHandlePrefix+did, cached)
 		return &cached, true, nil
 	} else if err != redis.Nil {
 		return nil, false, err
@@ -349,51 +532,198 @@ func (m *Mirage) GetHandleFromDid(did string) (*string, bool, error) {
 		return nil, false, err
 	}
 
+	if dh.Tombstoned {
+		return nil, false, ErrDidTombstoned
+	}
+
 	if dh.Handle == "" {
 		return nil, false, nil
 	}
 
 	m.r.Set(redisPrefix+didHandlePrefix+did, dh.Handle, 0)
+	m.localAdd(didHandlePrefix+did, dh.Handle)
 
 	return &dh.Handle, true, nil
 }
 
+// GetHandleFromDidAt returns the primary handle that the did had at the given time
+func (m *Mirage) GetHandleFromDidAt(did string, t time.Time) (*string, bool, error) {
+	op, err := m.GetLastOpAt(did, t)
+	if errors.Is(err, ErrDidNotFound) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if op.Operation.PlcTombstone != nil {
+		return nil, false, ErrDidTombstoned
+	}
+
+	handle, ok := entryHandle(op)
+	if !ok {
+		return nil, false, nil
+	}
+
+	return &handle, true, nil
+}
+
 func (m *Mirage) GetService(did string) (*string, bool, error) {
-	op, err := m.GetLastOp(did)
+	res, err := cachedRender(m, serviceCacheKind, did, func(op *PlcEntry) (*cachedService, error) {
+		endpoint, found, err := serviceFromEntry(op)
+		if err != nil || !found {
+			return &cachedService{}, err
+		}
+
+		return &cachedService{Endpoint: *endpoint, Found: true}, nil
+	})
 	if err != nil {
 		return nil, false, err
 	}
 
-	if op == nil || op.Operation.PlcTombstone != nil {
+	if !res.Found {
 		return nil, false, nil
 	}
 
-	if op.Operation.PlcOperation != nil {
-		pds, found := op.Operation.PlcOperation.Services["atproto_pds"]
-		if !found {
-			return nil, false, nil
-		}
+	return &res.Endpoint, true, nil
+}
 
-		return &pds.Endpoint, true, nil
-	} else if op.Operation.LegacyPlcOperation != nil {
-		return &op.Operation.LegacyPlcOperation.Service, true, nil
+// GetServiceAt is GetService as of the given time
+func (m *Mirage) GetServiceAt(did string, t time.Time) (*string, bool, error) {
+	op, err := m.GetLastOpAt(did, t)
+	if err != nil {
+		return nil, false, err
 	}
 
-	return nil, false, nil
+	return serviceFromEntry(op)
 }
 
+func serviceFromEntry(op *PlcEntry) (*string, bool, error) {
+	normalized := op.Operation.Normalized()
+	if normalized == nil {
+		return nil, false, ErrDidTombstoned
+	}
+
+	pds, found := normalized.Services[atprotoPdsService]
+	if !found {
+		return nil, false, nil
+	}
+
+	return &pds.Endpoint, true, nil
+}
+
+// GetDidFromHandle returns the did that claims a handle. Primary handles are cached in redis, any
+// other at:// handle in a did's alsoKnownAs is looked up in did_aliases, and is only served if the
+// handle resolves back to a did that lists it.
 func (m *Mirage) GetDidFromHandle(handle string) (*string, bool, error) {
+	if did, ok := localGet[string](m, handleDidPrefix+handle); ok {
+		return &did, true, nil
+	}
+
 	cached, err := m.r.Get(redisPrefix + handleDidPrefix + handle).Result()
 	if err == nil {
+		m.localAdd(handleDidPrefix+handle, cached)
 		return &cached, true, nil
-	} else {
-		return nil, false, errors.New("handle not found in cache. it may exist, but we are not tracking it")
+	} else if err != redis.Nil {
+		return nil, false, err
+	}
+
+	// every did listing the handle as an alias, earliest claim first
+	var dids []string
+	if err := m.db.c.Raw(`
+SELECT a.did
+FROM did_aliases a
+JOIN did_handles d ON d.did = a.did
+WHERE a.handle = ? AND NOT d.tombstoned
+ORDER BY (SELECT MIN(h.created_at) FROM handle_history h WHERE h.did = a.did AND h.handle = a.handle) ASC NULLS LAST, a.id ASC`, handle).Scan(&dids).Error; err != nil {
+		return nil, false, err
+	}
+
+	if len(dids) == 0 {
+		return nil, false, nil
+	}
+
+	// any did can list any handle, so the handle has to point back at one of them before it is
+	// cached. if it can't be resolved, the earliest claim is served without being cached.
+	resolved, err := m.ResolveHandle(m.ctx, handle)
+	if err != nil {
+		m.logger.Warn("failed to resolve alias handle", "handle", handle, "err", err)
+		return &dids[0], true, nil
+	}
+
+	if !slices.Contains(dids, resolved) {
+		return nil, false, nil
+	}
+
+	m.localAdd(handleDidPrefix+handle, resolved)
+
+	return &resolved, true, nil
+}
+
+// GetDidFromHandleAt returns the did that claimed the handle at the given time, according to the
+// handle history. If more than one did claimed it, the most recent claim wins.
+func (m *Mirage) GetDidFromHandleAt(handle string, t time.Time) (*string, bool, error) {
+	ts := t.UTC().Format(createdAtFormat)
+
+	var dids []string
+	if err := m.db.c.Raw(`
+SELECT c.did
+FROM handle_history c
+JOIN plc_entries e ON e.cid = c.cid
+WHERE c.handle = ? AND c.created_at <= ? AND NOT e.nullified AND NOT e.invalid
+	AND NOT EXISTS (
+		SELECT 1 FROM handle_history r
+		JOIN plc_entries re ON re.cid = r.cid
+		WHERE r.did = c.did AND r.is_primary = c.is_primary AND r.prev_handle = c.handle
+			AND r.created_at > c.created_at AND r.created_at <= ? AND NOT re.nullified AND NOT re.invalid
+	)
+ORDER BY c.created_at DESC
+LIMIT 1`, handle, ts, ts).Scan(&dids).Error; err != nil {
+		return nil, false, err
+	}
+
+	if len(dids) == 0 {
+		return nil, false, nil
+	}
+
+	return &dids[0], true, nil
+}
+
+// GetHandleHistory returns every handle change of a did, oldest first
+func (m *Mirage) GetHandleHistory(did string) ([]HandleHistory, error) {
+	var hhs []HandleHistory
+	if err := m.db.c.Raw("SELECT h.*, e.nullified FROM handle_history h JOIN plc_entries e ON e.cid = h.cid WHERE h.did = ? ORDER BY h.created_at ASC, h.is_primary DESC, h.id ASC", did).Scan(&hhs).Error; err != nil {
+		return nil, err
+	}
+
+	return hhs, nil
+}
+
+// GetHandleClaims returns every period of time during which a did claimed the handle, oldest first.
+// A claim is released by the next change that moves the handle off of the same kind of slot, so a
+// did that demotes its primary handle to a secondary one has two claims.
+func (m *Mirage) GetHandleClaims(handle string) ([]HandleClaim, error) {
+	var claims []HandleClaim
+	if err := m.db.c.Raw(`
+SELECT c.did, c.cid, c.is_primary, c.created_at AS claimed_at, r.created_at AS released_at, r.cid AS released_cid, e.nullified
+FROM handle_history c
+JOIN plc_entries e ON e.cid = c.cid
+LEFT JOIN LATERAL (
+	SELECT created_at, cid FROM handle_history
+	WHERE did = c.did AND is_primary = c.is_primary AND prev_handle = c.handle AND created_at > c.created_at
+	ORDER BY created_at ASC
+	LIMIT 1
+) r ON true
+WHERE c.handle = ?
+ORDER BY c.created_at ASC, c.is_primary DESC`, handle).Scan(&claims).Error; err != nil {
+		return nil, err
 	}
+
+	return claims, nil
 }
 
 func (m *Mirage) GetCreatedAt(did string) (*string, bool, error) {
 	var entries []PlcEntry
-	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE did = ? ORDER BY created_at ASC LIMIT 1", did).Scan(&entries).Error; err != nil {
+	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE did = ? AND NOT invalid ORDER BY created_at ASC LIMIT 1", did).Scan(&entries).Error; err != nil {
 		return nil, false, err
 	}
 
@@ -417,167 +747,20 @@ func (m *Mirage) GetDidHandles(cursor *uint) ([]DidHandle, error) {
 	return didHandles, nil
 }
 
-func (m *Mirage) runExporter(_ *MirageServerArgs) {
-	m.wg.Add(1)
-	go func() {
-		defer m.wg.Done()
-
-		after, err := m.r.Get(redisPrefix + "after").Result()
-		if err != nil && err != redis.Nil {
-			m.logger.Error("failed to get after", "err", err)
-			return
-		}
-
-		for {
-			select {
-			case <-m.ctx.Done():
-				return
-			default:
-				m.logger.Info("exporting", "cursor", after)
-
-				ustr := plcRoot + "/export?limit=1000"
-				waitMs := 1000
-
-				if after != "" {
-					ustr += "&after=" + after
-
-					t, _ := time.Parse(time.RFC3339Nano, after)
-					if time.Since(t) > 1*time.Hour {
-						waitMs = 600
-					}
-				}
-
-				time.Sleep(time.Duration(waitMs) * time.Millisecond)
-
-				req, err := http.NewRequestWithContext(m.ctx, "GET", ustr, nil)
-				if err != nil {
-					m.logger.Error("failed to create request", "err", err)
-					continue
-				}
-
-				resp, err := m.client.Do(req)
-				if err != nil {
-					m.logger.Error("failed to get export", "err", err)
-					continue
-				}
-				defer resp.Body.Close()
-
-				if resp.StatusCode != http.StatusOK {
-					m.logger.Error("export returned non-200 status", "status", resp.StatusCode)
-					continue
-				}
-
-				b, err := io.ReadAll(resp.Body)
-				if err != nil {
-					m.logger.Error("failed to read export", "err", err)
-					continue
-				}
-
-				pts := strings.Split(string(b), "\n")
-				for i, pt := range pts {
-					func() {
-						if pt == "" {
-							return
-						}
-
-						var entry PlcEntry
-						err = json.Unmarshal([]byte(pt), &entry)
-						if err != nil {
-							m.logger.Error("failed to unmarshal export", "err", err)
-							return
-						}
-
-						if i == len(pts)-1 {
-							m.r.Set(redisPrefix+"after", entry.CreatedAt, 0)
-							after = entry.CreatedAt
-						}
-
-						if _, err := m.r.Get(redisPrefix + didHandlePrefix + entry.Did).Result(); err != redis.Nil {
-							return
-						}
-
-						m.db.mu.Lock()
-						defer m.db.mu.Unlock()
-
-						if err := m.db.c.Create(&entry).Error; err != nil {
-							m.logger.Error("failed to create entry", "err", err)
-							return
-						}
-
-						if entry.Operation.PlcTombstone != nil {
-							if err := m.db.c.Exec("DELETE FROM did_handles WHERE did = ?", entry.Did).Error; err != nil {
-								m.logger.Error("failed to delete did handles", "err", err)
-								return
-							}
-						} else {
-							handle := ""
-							if entry.Operation.PlcOperation != nil {
-								if len(entry.Operation.PlcOperation.AlsoKnownAs) == 0 {
-									m.logger.Info("encountered operation with no aka", "did", entry.Did)
-									return
-								}
-								handle = entry.Operation.PlcOperation.AlsoKnownAs[0]
-							} else if entry.Operation.LegacyPlcOperation != nil {
-								handle = entry.Operation.LegacyPlcOperation.Handle
-							}
-							handle = strings.TrimPrefix(handle, "at://")
-
-							t, err := time.Parse(time.RFC3339Nano, entry.CreatedAt)
-							if err != nil {
-								m.logger.Error("failed to parse created at", "err", err)
-								return
-							}
-
-							if err := m.db.c.Clauses(clause.OnConflict{
-								Columns:   []clause.Column{{Name: "did"}},
-								DoUpdates: clause.AssignmentColumns([]string{"handle", "updated_at"}),
-							}).Create(&DidHandle{
-								Did:       entry.Did,
-								Handle:    handle,
-								UpdatedAt: t,
-							}).Error; err != nil {
-								m.logger.Error("failed to create did handle", "err", err)
-								return
-							}
-
-							m.r.Set(redisPrefix+didHandlePrefix+entry.Did, handle, 0)
-
-							curr, err := m.r.Get(redisPrefix + handleDidPrefix + handle).Result()
-							if err == redis.Nil {
-								m.r.Set(redisPrefix+handleDidPrefix+handle, entry.Did, 0)
-							} else if err != nil {
-								m.logger.Error("failed to get handle did", "err", err)
-								return
-							} else if curr != entry.Did {
-								res, err := m.ResolveHandle(handle)
-								if err != nil {
-									m.logger.Error("failed to resolve handle", "err", err)
-									return
-								}
-
-								if *res != entry.Did {
-									m.logger.Error("handle did mismatch", "handle", handle, "did", entry.Did, "resolved", *res)
-									return
-								}
-							}
-						}
-					}()
-				}
-			}
-		}
-	}()
-}
-
 func (m *Mirage) FillRedis(skip int) error {
 	handleUsed := map[string]string{}
 
 	m.logger.Info("fetching rows...")
 
 	var dhs []DidHandle
-	if err := m.db.c.Raw("SELECT * FROM did_handles").Scan(&dhs).Error; err != nil {
+	if err := m.db.c.Raw("SELECT * FROM did_handles WHERE NOT tombstoned AND handle <> ''").Scan(&dhs).Error; err != nil {
 		return err
 	}
 
+	if skip < 0 || skip > len(dhs) {
+		return fmt.Errorf("cannot skip %d of %d did handles", skip, len(dhs))
+	}
+
 	dhs = dhs[skip:]
 
 	println("\n")
@@ -588,20 +771,15 @@ func (m *Mirage) FillRedis(skip int) error {
 		if found && did != dh.Did {
 
 			println("trying to verify dupe handle")
-			did, err := m.ResolveHandle(dh.Handle)
+			did, err := m.ResolveHandle(m.ctx, dh.Handle)
 			if err != nil {
 				fmt.Printf("\nfailed to resolve handle: %v", err)
 				println("\nfailed to resolve handle", dh.Handle)
 				continue
 			}
 
-			if did == nil {
-				println("\nfailed to resolve handle", dh.Handle)
-				continue
-			}
-
-			if *did != dh.Did {
-				println("\nhandle did mismatch", dh.Handle, dh.Did, *did)
+			if did != dh.Did {
+				println("\nhandle did mismatch", dh.Handle, dh.Did, did)
 				continue
 			}
 
@@ -618,155 +796,36 @@ func (m *Mirage) FillRedis(skip int) error {
 	return nil
 }
 
-func (m *Mirage) RunExporter(_ *MirageServerArgs) {
-	m.wg.Add(1)
-	go func() {
-		defer m.wg.Done()
+// RebuildCache throws away everything mirage has in redis and refills the handle caches from
+// postgres. Postgres is the source of truth, so this is always safe to run.
+func (m *Mirage) RebuildCache() error {
+	// moves the redis cursor of older deployments over first, so that it isn't lost
+	if _, err := m.getCursor(); err != nil {
+		return fmt.Errorf("failed to get after: %w", err)
+	}
+
+	m.logger.Info("clearing redis")
 
-		after, err := m.r.Get(redisPrefix + "after").Result()
-		if err != nil && err != redis.Nil {
-			m.logger.Error("failed to get after", "err", err)
-			return
+	var cursor uint64
+	for {
+		keys, next, err := m.r.Scan(cursor, redisPrefix+"*", 1000).Result()
+		if err != nil {
+			return fmt.Errorf("failed to scan redis: %w", err)
 		}
 
-		for {
-			select {
-			case <-m.ctx.Done():
-				return
-			default:
-				m.logger.Info("exporting", "cursor", after)
-
-				ustr := plcRoot + "/export?limit=1000"
-				waitMs := 3000
-
-				if after != "" {
-					ustr += "&after=" + after
-
-					t, _ := time.Parse(time.RFC3339Nano, after)
-					if time.Since(t) > 1*time.Hour {
-						waitMs = 600
-					}
-				}
-
-				time.Sleep(time.Duration(waitMs) * time.Millisecond)
-
-				req, err := http.NewRequestWithContext(m.ctx, "GET", ustr, nil)
-				if err != nil {
-					m.logger.Error("failed to create request", "err", err)
-					continue
-				}
-
-				resp, err := m.client.Do(req)
-				if err != nil {
-					m.logger.Error("failed to get export", "err", err)
-					continue
-				}
-				defer resp.Body.Close()
-
-				if resp.StatusCode != http.StatusOK {
-					m.logger.Error("export returned non-200 status", "status", resp.StatusCode)
-					continue
-				}
-
-				b, err := io.ReadAll(resp.Body)
-				if err != nil {
-					m.logger.Error("failed to read export", "err", err)
-					continue
-				}
-
-				pts := strings.Split(string(b), "\n")
-				for i, pt := range pts {
-					func() {
-						if pt == "" {
-							return
-						}
-
-						var entry PlcEntry
-						err = json.Unmarshal([]byte(pt), &entry)
-						if err != nil {
-							m.logger.Error("failed to unmarshal export", "err", err)
-							return
-						}
-
-						if i == len(pts)-1 {
-							m.r.Set(redisPrefix+"after", entry.CreatedAt, 0)
-							after = entry.CreatedAt
-						}
-
-						if _, err := m.r.Get(redisPrefix + didHandlePrefix + entry.Did).Result(); err != redis.Nil {
-							return
-						}
-
-						m.db.mu.Lock()
-						defer m.db.mu.Unlock()
-
-						if err := m.db.c.Create(&entry).Error; err != nil {
-							m.logger.Error("failed to create entry", "err", err)
-							return
-						}
-
-						if entry.Operation.PlcTombstone != nil {
-							if err := m.db.c.Exec("DELETE FROM did_handles WHERE did = ?", entry.Did).Error; err != nil {
-								m.logger.Error("failed to delete did handles", "err", err)
-								return
-							}
-						} else {
-							handle := ""
-							if entry.Operation.PlcOperation != nil {
-								if len(entry.Operation.PlcOperation.AlsoKnownAs) == 0 {
-									m.logger.Info("encountered operation with no aka", "did", entry.Did)
-									return
-								}
-								handle = entry.Operation.PlcOperation.AlsoKnownAs[0]
-							} else if entry.Operation.LegacyPlcOperation != nil {
-								handle = entry.Operation.LegacyPlcOperation.Handle
-							}
-							handle = strings.TrimPrefix(handle, "at://")
-
-							t, err := time.Parse(time.RFC3339Nano, entry.CreatedAt)
-							if err != nil {
-								m.logger.Error("failed to parse created at", "err", err)
-								return
-							}
-
-							if err := m.db.c.Clauses(clause.OnConflict{
-								Columns:   []clause.Column{{Name: "did"}},
-								DoUpdates: clause.AssignmentColumns([]string{"handle", "updated_at"}),
-							}).Create(&DidHandle{
-								Did:       entry.Did,
-								Handle:    handle,
-								UpdatedAt: t,
-							}).Error; err != nil {
-								m.logger.Error("failed to create did handle", "err", err)
-								return
-							}
-
-							m.r.Set(redisPrefix+didHandlePrefix+entry.Did, handle, 0)
-
-							curr, err := m.r.Get(redisPrefix + handleDidPrefix + handle).Result()
-							if err == redis.Nil {
-								m.r.Set(redisPrefix+handleDidPrefix+handle, entry.Did, 0)
-							} else if err != nil {
-								m.logger.Error("failed to get handle did", "err", err)
-								return
-							} else if curr != entry.Did {
-								res, err := m.ResolveHandle(handle)
-								if err != nil {
-									m.logger.Error("failed to resolve handle", "err", err)
-									return
-								}
-
-								if *res != entry.Did {
-									m.logger.Error("handle did mismatch", "handle", handle, "did", entry.Did, "resolved", *res)
-									return
-								}
-							}
-						}
-					}()
-				}
+		if len(keys) > 0 {
+			if err := m.r.Del(keys...).Err(); err != nil {
+				return fmt.Errorf("failed to delete redis keys: %w", err)
 			}
 		}
-	}()
+
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	return m.FillRedis(0)
 }
 
 func (m *Mirage) GetUpdatedInWindow(dur time.Duration) ([]DidHandle, error) {
@@ -0,0 +1,124 @@
+package mirage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testPostgresEnv holds a postgres dsn for tests that need a database, for example
+// "host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable". Those
+// tests are skipped when it isn't set.
+var testPostgresEnv = "MIRAGE_TEST_POSTGRES"
+
+// newTestMirage creates a Mirage backed by a fresh postgres schema and an in-memory redis. The
+// returned redis server can be used to inspect or seed keys directly.
+func newTestMirage(t *testing.T, upstream Upstream) (*Mirage, *miniredis.Miniredis) {
+	t.Helper()
+
+	dsn := os.Getenv(testPostgresEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testPostgresEnv)
+	}
+
+	cfg := &gorm.Config{Logger: logger.Discard}
+
+	admin, err := gorm.Open(postgres.Open(dsn), cfg)
+	if err != nil {
+		t.Fatalf("failed to connect to postgres: %v", err)
+	}
+
+	schema := fmt.Sprintf("mirage_test_%d", rand.Uint64())
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDb, err := admin.DB(); err == nil {
+			sqlDb.Close()
+		}
+	})
+
+	db, err := gorm.Open(postgres.Open(dsn+" search_path="+schema), cfg)
+	if err != nil {
+		t.Fatalf("failed to connect to postgres: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if sqlDb, err := db.DB(); err == nil {
+			sqlDb.Close()
+		}
+	})
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	mr := miniredis.RunT(t)
+
+	r := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+	t.Cleanup(func() { r.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m := &Mirage{
+		client:          http.DefaultClient,
+		upstream:        upstream,
+		pollInterval:    defaultPollInterval,
+		catchUpInterval: defaultCatchUpInterval,
+		pageSize:        defaultPageSize,
+		resolver:        NewHandleResolver(),
+		db:              &MirageDb{c: db},
+		r:               r,
+		logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		entries:         newBroker[*PlcEntry](),
+		handleEvents:    newBroker[*HandleEvent](),
+		ctx:             ctx,
+	}
+
+	t.Cleanup(func() {
+		cancel()
+		m.Wait()
+	})
+
+	return m, mr
+}
+
+func TestRebuildCacheKeepsLegacyCursor(t *testing.T) {
+	m, mr := newTestMirage(t, nil)
+
+	cursor := "2024-01-01T00:00:00.000Z"
+	mr.Set(redisPrefix+"after", cursor)
+	mr.Set(redisPrefix+didHandlePrefix+"did:plc:stale", "stale.test")
+
+	if err := m.RebuildCache(); err != nil {
+		t.Fatalf("failed to rebuild cache: %v", err)
+	}
+
+	if mr.Exists(redisPrefix + didHandlePrefix + "did:plc:stale") {
+		t.Fatal("expected the stale handle to be cleared")
+	}
+
+	state, err := m.GetSyncState()
+	if err != nil {
+		t.Fatalf("failed to get sync state: %v", err)
+	}
+
+	if state == nil || state.Cursor != cursor {
+		t.Fatalf("expected the redis cursor to be moved to postgres, got %+v", state)
+	}
+}
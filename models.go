@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -12,6 +13,108 @@ type DidHandle struct {
 	Did       string    `gorm:"uniqueIndex;index:idx_did_handle_did_created_at"`
 	Handle    string    `gorm:"index;index:idx_did_handle_handle_created_at"`
 	UpdatedAt time.Time `gorm:"index;index:idx_did_handle_did_created_at,sort:desc;index:idx_did_handle_handle_created_at,sort:desc"`
+	// Tombstoned is set once the did has been deactivated. The last known handle is kept.
+	Tombstoned bool `gorm:"not null;default:false"`
+}
+
+// DidAlias is one of the alsoKnownAs uris of a did's current operation, in the position it is listed
+// in. Handle is set for at:// uris, without the prefix.
+type DidAlias struct {
+	Id       uint   `gorm:"primaryKey"`
+	Did      string `gorm:"uniqueIndex:idx_did_alias_did_position"`
+	Position int    `gorm:"uniqueIndex:idx_did_alias_did_position"`
+	Uri      string
+	Handle   string `gorm:"index"`
+}
+
+// HandleHistory records every change to a did's handles, starting with its genesis operation.
+// Changes to the primary handle have IsPrimary set, and Handle is empty when the did stopped having
+// a handle, which includes being tombstoned. Every other at:// handle is recorded when it is added,
+// with an empty PrevHandle, and when it is removed, with an empty Handle.
+type HandleHistory struct {
+	Id         uint   `json:"-" gorm:"primaryKey"`
+	Did        string `json:"did" gorm:"index:idx_handle_history_did_created_at"`
+	Handle     string `json:"handle" gorm:"index:idx_handle_history_handle_created_at;uniqueIndex:idx_handle_history_change,priority:3"`
+	PrevHandle string `json:"prevHandle" gorm:"uniqueIndex:idx_handle_history_change,priority:4"`
+	Cid        string `json:"cid" gorm:"uniqueIndex:idx_handle_history_change,priority:1"`
+	IsPrimary  bool   `json:"isPrimary" gorm:"not null;default:true;uniqueIndex:idx_handle_history_change,priority:2"`
+	CreatedAt  string `json:"createdAt" gorm:"index:idx_handle_history_did_created_at;index:idx_handle_history_handle_created_at"`
+	// Nullified comes from the operation in plc_entries, since it may be nullified after the change
+	// is recorded
+	Nullified bool `json:"nullified" gorm:"<-:false;-:migration"`
+}
+
+func (HandleHistory) TableName() string {
+	return "handle_history"
+}
+
+// HandleClaim is a period of time during which a did claimed a handle, either as its primary handle
+// or as one of its other at:// handles. ReleasedAt is nil if the did still claims it.
+type HandleClaim struct {
+	Did         string  `json:"did"`
+	Cid         string  `json:"cid"`
+	IsPrimary   bool    `json:"isPrimary"`
+	ClaimedAt   string  `json:"claimedAt"`
+	ReleasedAt  *string `json:"releasedAt"`
+	ReleasedCid *string `json:"releasedCid"`
+	Nullified   bool    `json:"nullified"`
+}
+
+// HandleEvent describes a change to a row in did_handles. OldHandle is empty for a did we haven't
+// seen before, and NewHandle is empty when the did has been tombstoned.
+type HandleEvent struct {
+	Did        string `json:"did"`
+	OldHandle  string `json:"oldHandle"`
+	NewHandle  string `json:"newHandle"`
+	Tombstoned bool   `json:"tombstoned"`
+	// At is the createdAt of the operation that caused the change
+	At string `json:"at"`
+}
+
+// SyncState holds the export cursor along with some ingestion stats. There is only ever a single
+// row, and it is the source of truth for where ingestion resumes from.
+type SyncState struct {
+	Id     uint `gorm:"primaryKey"`
+	Cursor string
+	// LastCid is the cid of the last entry in the most recently ingested page
+	LastCid string
+	// Entries, InvalidEntries and Pages count everything ingested since the row was created
+	Entries        int64 `gorm:"not null;default:0"`
+	InvalidEntries int64 `gorm:"not null;default:0"`
+	Pages          int64 `gorm:"not null;default:0"`
+	UpdatedAt      time.Time
+}
+
+func (SyncState) TableName() string {
+	return "sync_state"
+}
+
+// Webhook is a registered receiver of identity events. Events and Dids filter which events are
+// delivered, and an empty filter matches everything.
+type Webhook struct {
+	Id        uint      `json:"id" gorm:"primaryKey"`
+	Url       string    `json:"url" gorm:"not null"`
+	Secret    string    `json:"secret,omitempty" gorm:"not null"`
+	Events    []string  `json:"events" gorm:"type:jsonb;serializer:json"`
+	Dids      []string  `json:"dids" gorm:"type:jsonb;serializer:json"`
+	CreatedAt time.Time `json:"createdAt"`
+	// ClaimedUntil is set while a replica is delivering to the webhook
+	ClaimedUntil *time.Time `json:"-"`
+}
+
+// WebhookDelivery is a queued identity event for a single webhook. A delivery is retried until it
+// succeeds or runs out of attempts, at which point FailedAt is set.
+type WebhookDelivery struct {
+	Id            uint `gorm:"primaryKey"`
+	WebhookId     uint `gorm:"index"`
+	Event         string
+	Payload       string
+	Attempts      int       `gorm:"not null;default:0"`
+	NextAttemptAt time.Time `gorm:"index"`
+	DeliveredAt   *time.Time
+	FailedAt      *time.Time
+	LastError     string
+	CreatedAt     time.Time
 }
 
 type PlcEntry struct {
@@ -21,6 +124,11 @@ type PlcEntry struct {
 	Cid       string           `json:"cid" gorm:"uniqueIndex;index:idx_plc_entry_did_cid"`
 	Nullified bool             `json:"nullified"`
 	CreatedAt string           `json:"createdAt" gorm:"index;index:idx_plc_entry_did_created_at"`
+
+	// Invalid is set when the operation failed verification during ingestion. Invalid entries are
+	// kept for inspection, but are never served.
+	Invalid       bool   `json:"-" gorm:"not null;default:false;index"`
+	InvalidReason string `json:"-"`
 }
 
 type PlcOperation struct {
@@ -45,15 +153,21 @@ type PlcService struct {
 }
 
 type LegacyPlcOperation struct {
-	Sig         string `json:"sig"`
-	Prev        string `json:"prev"`
-	Type        string `json:"type"`
-	Handle      string `json:"handle"`
-	Service     string `json:"service"`
-	SigningKey  string `json:"signingKey"`
-	RecoveryKey string `json:"recoveryKey"`
+	Sig         string  `json:"sig"`
+	Prev        *string `json:"prev"`
+	Type        string  `json:"type"`
+	Handle      string  `json:"handle"`
+	Service     string  `json:"service"`
+	SigningKey  string  `json:"signingKey"`
+	RecoveryKey string  `json:"recoveryKey"`
 }
 
+var (
+	atprotoVerificationMethod = "atproto"
+	atprotoPdsService         = "atproto_pds"
+	atprotoPdsServiceType     = "AtprotoPersonalDataServer"
+)
+
 type PlcOperationType struct {
 	PlcOperation       *PlcOperation
 	PlcTombstone       *PlcTombstone
@@ -102,9 +216,67 @@ func (o *PlcOperationType) UnmarshalJSON(data []byte) error {
 		}
 	}
 
+	// older rows were stored with an empty string rather than null for a legacy op's prev
+	if o.LegacyPlcOperation != nil && o.LegacyPlcOperation.Prev != nil && *o.LegacyPlcOperation.Prev == "" {
+		o.LegacyPlcOperation.Prev = nil
+	}
+
 	return nil
 }
 
+// MarshalJSON writes out the underlying operation in the same shape (and field order) that
+// plc.directory uses, so that the stored operation can be exported as-is.
+func (o PlcOperationType) MarshalJSON() ([]byte, error) {
+	if o.PlcOperation != nil {
+		return marshalJSONNoEscape(o.PlcOperation)
+	} else if o.PlcTombstone != nil {
+		return marshalJSONNoEscape(o.PlcTombstone)
+	} else if o.LegacyPlcOperation != nil {
+		return marshalJSONNoEscape(o.LegacyPlcOperation)
+	}
+
+	return nil, errors.New("operation is empty")
+}
+
+// Normalized returns the operation in the modern plc_operation shape. Legacy create operations are
+// converted the same way plc.directory converts them, and tombstones return nil.
+func (o *PlcOperationType) Normalized() *PlcOperation {
+	if o.PlcOperation != nil {
+		return o.PlcOperation
+	}
+
+	if o.LegacyPlcOperation == nil {
+		return nil
+	}
+
+	op := o.LegacyPlcOperation
+
+	handle := op.Handle
+	if !strings.HasPrefix(handle, "at://") {
+		handle = "at://" + strings.TrimPrefix(strings.TrimPrefix(handle, "http://"), "https://")
+	}
+
+	service := op.Service
+	if !strings.HasPrefix(service, "http://") && !strings.HasPrefix(service, "https://") {
+		service = "https://" + service
+	}
+
+	return &PlcOperation{
+		Sig:  op.Sig,
+		Prev: op.Prev,
+		Type: "plc_operation",
+		Services: map[string]PlcService{
+			atprotoPdsService: {
+				Type:     atprotoPdsServiceType,
+				Endpoint: service,
+			},
+		},
+		AlsoKnownAs:         []string{handle},
+		RotationKeys:        []string{op.RecoveryKey, op.SigningKey},
+		VerificationMethods: map[string]string{atprotoVerificationMethod: op.SigningKey},
+	}
+}
+
 func (o *PlcOperationType) Value() (interface{}, error) {
 	return json.Marshal(o)
 }
@@ -0,0 +1,79 @@
+package mirage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizedLegacy(t *testing.T) {
+	op := unmarshalOp(t, legacyVectorOp)
+
+	expected := &PlcOperation{
+		Sig:  op.Sig(),
+		Type: "plc_operation",
+		Services: map[string]PlcService{
+			atprotoPdsService: {Type: atprotoPdsServiceType, Endpoint: "https://bsky.social"},
+		},
+		AlsoKnownAs:         []string{"at://why.bsky.social"},
+		RotationKeys:        []string{legacyVectorKey, legacyVectorKey},
+		VerificationMethods: map[string]string{atprotoVerificationMethod: legacyVectorKey},
+	}
+
+	if got := op.Normalized(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestNormalizedLegacyPrefixes(t *testing.T) {
+	tests := []struct {
+		name      string
+		handle    string
+		service   string
+		expectAka string
+		expectPds string
+	}{
+		{"bare", "user.test", "pds.test", "at://user.test", "https://pds.test"},
+		{"at uri handle", "at://user.test", "pds.test", "at://user.test", "https://pds.test"},
+		{"http handle", "http://user.test", "pds.test", "at://user.test", "https://pds.test"},
+		{"https handle", "https://user.test", "pds.test", "at://user.test", "https://pds.test"},
+		{"https service", "user.test", "https://pds.test", "at://user.test", "https://pds.test"},
+		{"http service", "user.test", "http://pds.test", "at://user.test", "http://pds.test"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := &PlcOperationType{LegacyPlcOperation: &LegacyPlcOperation{
+				Type:        "create",
+				Handle:      tt.handle,
+				Service:     tt.service,
+				SigningKey:  "did:key:signing",
+				RecoveryKey: "did:key:recovery",
+			}}
+
+			normalized := op.Normalized()
+			if len(normalized.AlsoKnownAs) != 1 || normalized.AlsoKnownAs[0] != tt.expectAka {
+				t.Fatalf("expected alsoKnownAs %s, got %v", tt.expectAka, normalized.AlsoKnownAs)
+			}
+
+			if pds := normalized.Services[atprotoPdsService].Endpoint; pds != tt.expectPds {
+				t.Fatalf("expected pds %s, got %s", tt.expectPds, pds)
+			}
+
+			// the recovery key takes priority over the signing key
+			if !reflect.DeepEqual(normalized.RotationKeys, []string{"did:key:recovery", "did:key:signing"}) {
+				t.Fatalf("expected the recovery key first, got %v", normalized.RotationKeys)
+			}
+		})
+	}
+}
+
+func TestNormalizedOtherTypes(t *testing.T) {
+	op := unmarshalOp(t, genesisFixtureOp)
+	if op.Normalized() != op.PlcOperation {
+		t.Fatal("expected a plc operation to be returned as is")
+	}
+
+	if unmarshalOp(t, tombstoneFixtureOp).Normalized() != nil {
+		t.Fatal("expected a tombstone to have no document")
+	}
+}
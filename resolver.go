@@ -0,0 +1,218 @@
+package mirage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+var (
+	ErrHandleNotResolved  = errors.New("handle could not be resolved")
+	ErrConflictingRecords = errors.New("handle has conflicting did records")
+
+	defaultResolveTimeout = 5 * time.Second
+	resolveGracePeriod    = 500 * time.Millisecond
+
+	// a well-known response only ever contains a did, so anything larger than this is rejected
+	maxWellKnownSize = 2048
+
+	atprotoDnsPrefix = "_atproto."
+	atprotoTxtPrefix = "did="
+)
+
+// HandleResolver resolves handles to dids through the _atproto dns TXT record and the
+// /.well-known/atproto-did https endpoint. Both methods are tried at the same time, and if they both
+// return a did they have to agree. Once one method has returned a did, the other only has a short
+// grace period to return before the did is used.
+type HandleResolver struct {
+	// LookupTXT defaults to net.DefaultResolver.LookupTXT
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+	// Client is used for the well-known request. It defaults to a client that doesn't follow redirects.
+	Client *http.Client
+	// WellKnownUrl builds the url of a handle's well-known endpoint, defaulting to
+	// https://<handle>/.well-known/atproto-did
+	WellKnownUrl func(handle string) string
+	// Timeout bounds the whole resolution, defaulting to 5 seconds
+	Timeout time.Duration
+}
+
+func NewHandleResolver() *HandleResolver {
+	return &HandleResolver{
+		LookupTXT: net.DefaultResolver.LookupTXT,
+		Client: &http.Client{
+			Timeout: defaultResolveTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		WellKnownUrl: func(handle string) string {
+			return "https://" + handle + "/.well-known/atproto-did"
+		},
+		Timeout: defaultResolveTimeout,
+	}
+}
+
+type resolveResult struct {
+	did string
+	err error
+}
+
+// Resolve returns the did that a handle points at. ErrHandleNotResolved is returned when neither
+// method finds a did, and ErrConflictingRecords when the methods (or the dns records) disagree.
+func (r *HandleResolver) Resolve(ctx context.Context, handle string) (string, error) {
+	h, err := syntax.ParseHandle(handle)
+	if err != nil {
+		return "", fmt.Errorf("invalid handle: %w", err)
+	}
+	handle = h.Normalize().String()
+
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = defaultResolveTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dnsCh := make(chan resolveResult, 1)
+	httpCh := make(chan resolveResult, 1)
+
+	go func() {
+		did, err := r.resolveDns(ctx, handle)
+		dnsCh <- resolveResult{did, err}
+	}()
+
+	go func() {
+		did, err := r.resolveWellKnown(ctx, handle)
+		httpCh <- resolveResult{did, err}
+	}()
+
+	// once one method has found a did, the other is only given a moment to either agree or disagree,
+	// so that a slow dns server or web server doesn't hold up every resolution
+	var dnsRes, httpRes resolveResult
+	var grace <-chan time.Time
+	gotDns, gotHttp := false, false
+	for !gotDns || !gotHttp {
+		select {
+		case dnsRes = <-dnsCh:
+			gotDns = true
+		case httpRes = <-httpCh:
+			gotHttp = true
+		case <-grace:
+			if !gotDns {
+				dnsRes.err = errors.New("timed out after https resolved")
+			} else {
+				httpRes.err = errors.New("timed out after dns resolved")
+			}
+			gotDns, gotHttp = true, true
+		}
+
+		if grace == nil && (dnsRes.did != "" || httpRes.did != "") {
+			grace = time.After(resolveGracePeriod)
+		}
+	}
+
+	switch {
+	case dnsRes.did != "" && httpRes.did != "":
+		if dnsRes.did != httpRes.did {
+			return "", fmt.Errorf("%w: dns says %s, https says %s", ErrConflictingRecords, dnsRes.did, httpRes.did)
+		}
+		return dnsRes.did, nil
+	case dnsRes.did != "":
+		return dnsRes.did, nil
+	case httpRes.did != "":
+		return httpRes.did, nil
+	}
+
+	// a conflict is more useful to report than the other method simply not finding anything
+	if errors.Is(dnsRes.err, ErrConflictingRecords) {
+		return "", dnsRes.err
+	}
+
+	return "", fmt.Errorf("%w: dns: %s, https: %s", ErrHandleNotResolved, dnsRes.err, httpRes.err)
+}
+
+func (r *HandleResolver) resolveDns(ctx context.Context, handle string) (string, error) {
+	lookup := r.LookupTXT
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupTXT
+	}
+
+	records, err := lookup(ctx, atprotoDnsPrefix+handle)
+	if err != nil {
+		return "", err
+	}
+
+	found := ""
+	for _, rec := range records {
+		if !strings.HasPrefix(rec, atprotoTxtPrefix) {
+			continue
+		}
+
+		did, err := syntax.ParseDID(strings.TrimSpace(strings.TrimPrefix(rec, atprotoTxtPrefix)))
+		if err != nil {
+			continue
+		}
+
+		if found != "" && found != did.String() {
+			return "", fmt.Errorf("%w: dns has %s and %s", ErrConflictingRecords, found, did.String())
+		}
+		found = did.String()
+	}
+
+	if found == "" {
+		return "", errors.New("no did record found")
+	}
+
+	return found, nil
+}
+
+func (r *HandleResolver) resolveWellKnown(ctx context.Context, handle string) (string, error) {
+	ustr := "https://" + handle + "/.well-known/atproto-did"
+	if r.WellKnownUrl != nil {
+		ustr = r.WellKnownUrl(handle)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", ustr, nil)
+	if err != nil {
+		return "", err
+	}
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("non-200 status code %d", resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxWellKnownSize)+1))
+	if err != nil {
+		return "", err
+	}
+
+	if len(b) > maxWellKnownSize {
+		return "", errors.New("response is too large")
+	}
+
+	did, err := syntax.ParseDID(strings.TrimSpace(string(b)))
+	if err != nil {
+		return "", err
+	}
+
+	return did.String(), nil
+}
@@ -0,0 +1,222 @@
+package mirage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testResolveDid      = "did:plc:aaaaaaaaaaaaaaaaaaaaaaaa"
+	testResolveOtherDid = "did:plc:bbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+// newTestResolver creates a resolver that looks TXT records up in txt and serves the well-known
+// endpoint from handler. A nil handler responds with a 404.
+func newTestResolver(t *testing.T, txt map[string][]string, handler http.HandlerFunc) *HandleResolver {
+	t.Helper()
+
+	if handler == nil {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		}
+	}
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	return &HandleResolver{
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			records, ok := txt[name]
+			if !ok {
+				return nil, errors.New("no such host")
+			}
+			return records, nil
+		},
+		// the default client doesn't follow redirects
+		Client: NewHandleResolver().Client,
+		WellKnownUrl: func(handle string) string {
+			return srv.URL + "/.well-known/atproto-did"
+		},
+		Timeout: time.Second,
+	}
+}
+
+func wellKnown(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}
+}
+
+func TestResolveHandle(t *testing.T) {
+	tests := []struct {
+		name    string
+		handle  string
+		txt     map[string][]string
+		handler http.HandlerFunc
+		did     string
+		err     error
+		errText string
+	}{
+		{
+			name:   "dns",
+			handle: "alice.test",
+			txt:    map[string][]string{"_atproto.alice.test": {"did=" + testResolveDid}},
+			did:    testResolveDid,
+		},
+		{
+			name:   "dns ignores other records",
+			handle: "alice.test",
+			txt:    map[string][]string{"_atproto.alice.test": {"v=spf1 -all", "did=not-a-did", "did= " + testResolveDid + " "}},
+			did:    testResolveDid,
+		},
+		{
+			name:    "https",
+			handle:  "alice.test",
+			handler: wellKnown(testResolveDid + "\n"),
+			did:     testResolveDid,
+		},
+		{
+			name:    "dns and https agree",
+			handle:  "alice.test",
+			txt:     map[string][]string{"_atproto.alice.test": {"did=" + testResolveDid}},
+			handler: wellKnown(testResolveDid),
+			did:     testResolveDid,
+		},
+		{
+			name:   "handle is normalized",
+			handle: "Alice.TEST",
+			txt:    map[string][]string{"_atproto.alice.test": {"did=" + testResolveDid}},
+			did:    testResolveDid,
+		},
+		{
+			name:    "invalid handle",
+			handle:  "not a handle",
+			errText: "invalid handle",
+		},
+		{
+			name:    "invalid did",
+			handle:  "alice.test",
+			txt:     map[string][]string{"_atproto.alice.test": {"did=nope"}},
+			handler: wellKnown("nope"),
+			err:     ErrHandleNotResolved,
+		},
+		{
+			name:   "conflicting txt records",
+			handle: "alice.test",
+			txt:    map[string][]string{"_atproto.alice.test": {"did=" + testResolveDid, "did=" + testResolveOtherDid}},
+			err:    ErrConflictingRecords,
+		},
+		{
+			name:    "dns disagrees with https",
+			handle:  "alice.test",
+			txt:     map[string][]string{"_atproto.alice.test": {"did=" + testResolveDid}},
+			handler: wellKnown(testResolveOtherDid),
+			err:     ErrConflictingRecords,
+		},
+		{
+			name:    "oversized body",
+			handle:  "alice.test",
+			handler: wellKnown(testResolveDid + strings.Repeat(" ", maxWellKnownSize)),
+			err:     ErrHandleNotResolved,
+		},
+		{
+			name:   "non-200",
+			handle: "alice.test",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(testResolveDid))
+			},
+			err: ErrHandleNotResolved,
+		},
+		{
+			name:   "redirects are not followed",
+			handle: "alice.test",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/elsewhere" {
+					w.Write([]byte(testResolveDid))
+					return
+				}
+				http.Redirect(w, r, "/elsewhere", http.StatusFound)
+			},
+			err: ErrHandleNotResolved,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestResolver(t, tt.txt, tt.handler)
+
+			did, err := r.Resolve(context.Background(), tt.handle)
+			if tt.err != nil || tt.errText != "" {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", did)
+				}
+
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+
+				if !strings.Contains(err.Error(), tt.errText) {
+					t.Fatalf("expected an error containing %q, got %v", tt.errText, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("failed to resolve: %v", err)
+			}
+
+			if did != tt.did {
+				t.Fatalf("expected %s, got %s", tt.did, did)
+			}
+		})
+	}
+}
+
+func TestResolveHandleTimeout(t *testing.T) {
+	hang := func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}
+
+	t.Run("neither method answers", func(t *testing.T) {
+		r := newTestResolver(t, nil, hang)
+		r.LookupTXT = func(ctx context.Context, name string) ([]string, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		r.Timeout = 100 * time.Millisecond
+
+		start := time.Now()
+		if _, err := r.Resolve(context.Background(), "alice.test"); !errors.Is(err, ErrHandleNotResolved) {
+			t.Fatalf("expected %v, got %v", ErrHandleNotResolved, err)
+		}
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("expected the timeout to be respected, took %s", elapsed)
+		}
+	})
+
+	t.Run("one method answers", func(t *testing.T) {
+		r := newTestResolver(t, map[string][]string{"_atproto.alice.test": {"did=" + testResolveDid}}, hang)
+		r.Timeout = 10 * time.Second
+
+		start := time.Now()
+		did, err := r.Resolve(context.Background(), "alice.test")
+		if err != nil {
+			t.Fatalf("failed to resolve: %v", err)
+		}
+
+		if did != testResolveDid {
+			t.Fatalf("expected %s, got %s", testResolveDid, did)
+		}
+
+		if elapsed := time.Since(start); elapsed > resolveGracePeriod+time.Second {
+			t.Fatalf("expected not to wait for https, took %s", elapsed)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package mirage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	streamPingInterval = 30 * time.Second
+	streamWriteTimeout = 10 * time.Second
+
+	streamUpgrader = websocket.Upgrader{
+		// the stream only carries public data, so it may be consumed from any origin
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+)
+
+// handleExportStream pushes every entry that the exporter commits to a websocket as json, in the
+// same format as /export. If a cursor is supplied, entries created after it are replayed from the
+// database before live entries are sent. A client that can't keep up with the live stream is caught
+// up from the database again, so it never misses entries.
+func (m *Mirage) handleExportStream(e echo.Context) error {
+	// pos is the last entry that was sent, and entries are sent in (created_at, id) order. a cursor
+	// only has a created_at, so the id is set past every entry created at the same time.
+	var pos streamPos
+	if cstr := e.QueryParam("cursor"); cstr != "" {
+		c, err := normalizeCreatedAt(cstr)
+		if err != nil {
+			return e.JSON(http.StatusBadRequest, createError("invalid cursor"))
+		}
+		pos = streamPos{createdAt: c, id: math.MaxInt64}
+	} else {
+		// without a cursor the stream starts at the current end of the log. this is looked up before
+		// subscribing, so that anything committed in between is replayed rather than lost.
+		last, err := m.getStreamEnd()
+		if err != nil {
+			m.logger.Error("failed to get stream end", "err", err)
+			return e.JSON(http.StatusInternalServerError, createError("failed to start stream"))
+		}
+		pos = last
+	}
+
+	conn, err := streamUpgrader.Upgrade(e.Response(), e.Request(), nil)
+	if err != nil {
+		// the upgrader has already responded with an error
+		return nil
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(e.Request().Context())
+	defer cancel()
+
+	// nothing is expected from the client, but reading is needed to handle control frames and to
+	// notice when the client goes away
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(entry *PlcEntry) error {
+		b, err := marshalJSONNoEscape(entry)
+		if err != nil {
+			return err
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+			return err
+		}
+
+		pos = streamPos{createdAt: entry.CreatedAt, id: uint64(entry.ID)}
+		return nil
+	}
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	var sub chan *PlcEntry
+	defer func() {
+		m.entries.unsubscribe(sub)
+	}()
+
+	for {
+		// subscribing before replaying means that anything committed during the replay is queued on
+		// sub, and is skipped below if the replay already sent it
+		sub = m.entries.subscribe()
+
+		for {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			entries, err := m.getStreamPage(pos, exportMaxCount)
+			if err != nil {
+				m.logger.Error("failed to get stream replay", "cursor", pos.createdAt, "err", err)
+				return nil
+			}
+
+			for i := range entries {
+				if err := write(&entries[i]); err != nil {
+					return nil
+				}
+			}
+
+			if len(entries) < exportMaxCount {
+				break
+			}
+		}
+
+	live:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-m.ctx.Done():
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(streamWriteTimeout))
+				return nil
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+					return nil
+				}
+			case entry, ok := <-sub:
+				if !ok {
+					break live
+				}
+
+				if !pos.before(entry) {
+					continue
+				}
+
+				if err := write(entry); err != nil {
+					return nil
+				}
+			}
+		}
+
+		m.logger.Warn("stream client fell behind, catching up from the database", "cursor", pos.createdAt)
+	}
+}
+
+// streamPos is a position in the log of valid entries, which is ordered by created_at and then id
+type streamPos struct {
+	createdAt string
+	id        uint64
+}
+
+// before returns whether the entry comes after the position
+func (p streamPos) before(entry *PlcEntry) bool {
+	return entry.CreatedAt > p.createdAt || (entry.CreatedAt == p.createdAt && uint64(entry.ID) > p.id)
+}
+
+// getStreamPage returns the valid entries after the position
+func (m *Mirage) getStreamPage(pos streamPos, count int) ([]PlcEntry, error) {
+	var entries []PlcEntry
+	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE (created_at > ? OR (created_at = ? AND id > ?)) AND NOT invalid ORDER BY created_at ASC, id ASC LIMIT ?", pos.createdAt, pos.createdAt, pos.id, count).Scan(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// getStreamEnd returns the position of the last valid entry, or the start of the log if there are
+// no entries
+func (m *Mirage) getStreamEnd() (streamPos, error) {
+	var entries []PlcEntry
+	if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE NOT invalid ORDER BY created_at DESC, id DESC LIMIT 1").Scan(&entries).Error; err != nil {
+		return streamPos{}, err
+	}
+
+	if len(entries) == 0 {
+		return streamPos{}, nil
+	}
+
+	return streamPos{createdAt: entries[0].CreatedAt, id: uint64(entries[0].ID)}, nil
+}
+
+// handleHandleEvents streams every change to did_handles as server-sent events. There is no replay,
+// so a client that can't keep up is disconnected and is expected to reconnect.
+func (m *Mirage) handleHandleEvents(e echo.Context) error {
+	sub := m.handleEvents.subscribe()
+	defer m.handleEvents.unsubscribe(sub)
+
+	resp := e.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/event-stream")
+	resp.Header().Set(echo.HeaderCacheControl, "no-cache")
+	resp.Header().Set(echo.HeaderConnection, "keep-alive")
+	resp.WriteHeader(http.StatusOK)
+	resp.Flush()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-e.Request().Context().Done():
+			return nil
+		case <-m.ctx.Done():
+			return nil
+		case <-ping.C:
+			if _, err := resp.Write([]byte(": ping\n\n")); err != nil {
+				return nil
+			}
+			resp.Flush()
+		case evt, ok := <-sub:
+			if !ok {
+				m.logger.Warn("handle event client fell behind, disconnecting")
+				return nil
+			}
+
+			b, err := marshalJSONNoEscape(evt)
+			if err != nil {
+				m.logger.Error("failed to marshal handle event", "did", evt.Did, "err", err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(resp, "event: handle\ndata: %s\n\n", b); err != nil {
+				return nil
+			}
+			resp.Flush()
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package mirage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+func TestStreamPosBefore(t *testing.T) {
+	pos := streamPos{createdAt: "2024-01-01T00:00:00.000Z", id: 10}
+
+	tests := []struct {
+		name   string
+		entry  *PlcEntry
+		expect bool
+	}{
+		{"earlier", &PlcEntry{ID: 20, CreatedAt: "2023-12-31T23:59:59.999Z"}, false},
+		{"same entry", &PlcEntry{ID: 10, CreatedAt: "2024-01-01T00:00:00.000Z"}, false},
+		{"same time, earlier id", &PlcEntry{ID: 9, CreatedAt: "2024-01-01T00:00:00.000Z"}, false},
+		{"same time, later id", &PlcEntry{ID: 11, CreatedAt: "2024-01-01T00:00:00.000Z"}, true},
+		{"later", &PlcEntry{ID: 1, CreatedAt: "2024-01-01T00:00:00.001Z"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pos.before(tt.entry); got != tt.expect {
+				t.Fatalf("expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+// dialStream connects to the export stream of a test server
+func dialStream(t *testing.T, srv *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/export/stream"+query, nil)
+	if err != nil {
+		t.Fatalf("failed to dial stream: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// readStream reads count entries from the stream
+func readStream(t *testing.T, conn *websocket.Conn, count int) []PlcEntry {
+	t.Helper()
+
+	var entries []PlcEntry
+	for range count {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read stream: %v", err)
+		}
+
+		var entry PlcEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			t.Fatalf("failed to unmarshal entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// expectNoMore checks that nothing else arrives on the stream for a moment
+func expectNoMore(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, b, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("expected nothing else on the stream, got %s", b)
+	}
+}
+
+func TestExportStream(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+
+	// entries that share a millisecond must all be sent exactly once
+	_, first := newTestIdentity(t, start, "first.test")
+	_, second := newTestIdentity(t, start, "second.test")
+	_, third := newTestIdentity(t, start.Add(time.Second), "third.test")
+	_, fourth := newTestIdentity(t, start.Add(time.Second), "fourth.test")
+
+	m, _ := newTestMirage(t, nil)
+
+	if _, err := m.ingestPage(pageOf(t, first, second), ""); err != nil {
+		t.Fatalf("failed to ingest page: %v", err)
+	}
+
+	srv := httptest.NewServer(m.newRouter(&MirageServerArgs{}))
+	t.Cleanup(srv.Close)
+
+	replayed := dialStream(t, srv, "?cursor="+start.Add(-time.Second).UTC().Format(createdAtFormat))
+	live := dialStream(t, srv, "")
+
+	entries := readStream(t, replayed, 2)
+	if entries[0].Cid != first.Cid || entries[1].Cid != second.Cid {
+		t.Fatalf("expected the stored entries to be replayed, got %s and %s", entries[0].Cid, entries[1].Cid)
+	}
+
+	// the live client started at the end of the log, so it gets this page whether or not it has
+	// subscribed yet
+	if _, err := m.ingestPage(pageOf(t, third, fourth), first.CreatedAt); err != nil {
+		t.Fatalf("failed to ingest page: %v", err)
+	}
+
+	for _, conn := range []*websocket.Conn{replayed, live} {
+		entries := readStream(t, conn, 2)
+		if entries[0].Cid != third.Cid || entries[1].Cid != fourth.Cid {
+			t.Fatalf("expected the new entries, got %s and %s", entries[0].Cid, entries[1].Cid)
+		}
+
+		expectNoMore(t, conn)
+	}
+}
+
+// readEvent reads the next server-sent event, skipping any pings
+func readEvent(t *testing.T, rdr *bufio.Reader) (string, string) {
+	t.Helper()
+
+	var event, data string
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && event != "":
+			return event, data
+		}
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := &Mirage{
+		ctx:          ctx,
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		handleEvents: newBroker[*HandleEvent](),
+	}
+
+	e := echo.New()
+	e.GET("/events/handles", m.handleHandleEvents)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	connect := func() *bufio.Reader {
+		resp, err := http.Get(srv.URL + "/events/handles")
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+
+		if ct := resp.Header.Get(echo.HeaderContentType); ct != "text/event-stream" {
+			t.Fatalf("expected an event stream, got %q", ct)
+		}
+
+		return bufio.NewReader(resp.Body)
+	}
+
+	// the handler subscribes before it writes the headers, so both clients get everything after this
+	first := connect()
+	second := connect()
+
+	published := []*HandleEvent{
+		{Did: "did:plc:a", NewHandle: "a.test", At: "2024-01-01T00:00:00.000Z"},
+		{Did: "did:plc:a", OldHandle: "a.test", Tombstoned: true, At: "2024-01-02T00:00:00.000Z"},
+	}
+	for _, evt := range published {
+		m.handleEvents.publish(evt)
+	}
+
+	for _, rdr := range []*bufio.Reader{first, second} {
+		for _, expected := range published {
+			event, data := readEvent(t, rdr)
+			if event != "handle" {
+				t.Fatalf("expected a handle event, got %q", event)
+			}
+
+			var evt HandleEvent
+			if err := json.Unmarshal([]byte(data), &evt); err != nil {
+				t.Fatalf("failed to unmarshal event: %v", err)
+			}
+
+			if evt != *expected {
+				t.Fatalf("expected %+v, got %+v", *expected, evt)
+			}
+		}
+	}
+
+	// clients that fall behind are disconnected
+	m.handleEvents.mu.Lock()
+	for ch := range m.handleEvents.subs {
+		delete(m.handleEvents.subs, ch)
+		close(ch)
+	}
+	m.handleEvents.mu.Unlock()
+
+	for _, rdr := range []*bufio.Reader{first, second} {
+		if _, err := io.ReadAll(rdr); err != nil {
+			t.Fatalf("expected the stream to end, got %v", err)
+		}
+	}
+
+	// as is every client on shutdown
+	third := connect()
+	cancel()
+
+	if _, err := io.ReadAll(third); err != nil {
+		t.Fatalf("expected the stream to end, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package mirage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Upstream is a source of plc export pages. An upstream returns newline delimited PlcEntry json in
+// the same format as plc.directory's /export, containing at most count entries that were created
+// after the supplied cursor. An empty page means that there is nothing new yet.
+type Upstream interface {
+	Export(ctx context.Context, after string, count int) ([]byte, error)
+}
+
+// NewUpstream creates an upstream from a configuration string. http(s) urls are treated as either
+// a plc directory root or a full /export url (plc.directory or another mirage instance), and
+// anything else is treated as a path to a jsonl file or a directory of jsonl export pages.
+func NewUpstream(upstream string, client *http.Client) (Upstream, error) {
+	if upstream == "" {
+		upstream = defaultUpstream
+	}
+
+	if strings.HasPrefix(upstream, "http://") || strings.HasPrefix(upstream, "https://") {
+		return NewHTTPUpstream(upstream, client)
+	}
+
+	return NewFileUpstream(strings.TrimPrefix(upstream, "file://"))
+}
+
+type HTTPUpstream struct {
+	exportUrl string
+	client    *http.Client
+}
+
+func NewHTTPUpstream(root string, client *http.Client) (*HTTPUpstream, error) {
+	u, err := url.Parse(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream url: %w", err)
+	}
+
+	if !strings.HasSuffix(u.Path, "/export") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/export"
+	}
+
+	return &HTTPUpstream{
+		exportUrl: u.String(),
+		client:    client,
+	}, nil
+}
+
+func (u *HTTPUpstream) Export(ctx context.Context, after string, count int) ([]byte, error) {
+	ustr := u.exportUrl + "?count=" + strconv.Itoa(count)
+	if after != "" {
+		ustr += "&after=" + url.QueryEscape(after)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", ustr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get export: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("export returned non-200 status %d", resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read export: %w", err)
+	}
+
+	return b, nil
+}
+
+// FileUpstream reads export pages from a local jsonl file, or from every file inside of a directory
+// in name order. Files are expected to be in created_at order, like a dump of plc.directory's export.
+type FileUpstream struct {
+	files []string
+
+	mu sync.Mutex
+	// position of the next unread line, so that sequential pages don't rescan the files. the
+	// position is only reused when asked for the page that follows the last one returned.
+	fileIdx int
+	offset  int64
+	last    string
+}
+
+func NewFileUpstream(path string) (*FileUpstream, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat upstream path: %w", err)
+	}
+
+	files := []string{path}
+	if fi.IsDir() {
+		des, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream dir: %w", err)
+		}
+
+		files = []string{}
+		for _, de := range des {
+			if de.IsDir() || strings.HasPrefix(de.Name(), ".") {
+				continue
+			}
+			files = append(files, filepath.Join(path, de.Name()))
+		}
+		sort.Strings(files)
+	}
+
+	return &FileUpstream{
+		files: files,
+	}, nil
+}
+
+func (u *FileUpstream) Export(ctx context.Context, after string, count int) ([]byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if after == "" || after != u.last {
+		u.fileIdx = 0
+		u.offset = 0
+	}
+
+	var out bytes.Buffer
+	n := 0
+
+	for u.fileIdx < len(u.files) && n < count {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		f, err := os.Open(u.files[u.fileIdx])
+		if err != nil {
+			return nil, fmt.Errorf("failed to open upstream file: %w", err)
+		}
+
+		if _, err := f.Seek(u.offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to seek upstream file: %w", err)
+		}
+
+		rdr := bufio.NewReader(f)
+		for n < count {
+			line, err := rdr.ReadBytes('\n')
+			if err == io.EOF && !json.Valid(line) {
+				// don't consume a partial line, it may still be being written
+				break
+			}
+			u.offset += int64(len(line))
+
+			if err != nil && err != io.EOF {
+				f.Close()
+				return nil, fmt.Errorf("failed to read upstream file: %w", err)
+			}
+
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 {
+				continue
+			}
+
+			var entry struct {
+				CreatedAt string `json:"createdAt"`
+			}
+			if err := json.Unmarshal(line, &entry); err != nil {
+				// let the exporter deal with lines that fail to parse
+				out.Write(line)
+				out.WriteByte('\n')
+				n++
+				continue
+			}
+
+			if entry.CreatedAt <= after {
+				continue
+			}
+
+			out.Write(line)
+			out.WriteByte('\n')
+			n++
+			u.last = entry.CreatedAt
+		}
+		f.Close()
+
+		if n < count && u.fileIdx < len(u.files)-1 {
+			u.fileIdx++
+			u.offset = 0
+		} else {
+			break
+		}
+	}
+
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+}
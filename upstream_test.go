@@ -0,0 +1,133 @@
+package mirage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func fileLine(cid, createdAt string) string {
+	return fmt.Sprintf(`{"did":"did:plc:test","cid":"%s","createdAt":"%s"}`, cid, createdAt)
+}
+
+// exportCids returns the cids of the entries in an export page
+func exportCids(t *testing.T, u Upstream, after string, count int) []string {
+	t.Helper()
+
+	page, err := u.Export(context.Background(), after, count)
+	if err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+
+	var cids []string
+	for _, entry := range parseExportPage(t, page) {
+		cids = append(cids, entry.Cid)
+	}
+
+	return cids
+}
+
+func parseExportPage(t *testing.T, page []byte) []PlcEntry {
+	t.Helper()
+
+	var entries []PlcEntry
+	for _, line := range strings.Split(string(page), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var entry PlcEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("failed to unmarshal %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestFileUpstreamDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string][]string{
+		"0002.jsonl": {fileLine("c", "2024-01-03T00:00:00.000Z"), fileLine("d", "2024-01-04T00:00:00.000Z")},
+		"0001.jsonl": {fileLine("a", "2024-01-01T00:00:00.000Z"), fileLine("b", "2024-01-02T00:00:00.000Z")},
+		".partial":   {fileLine("x", "2024-01-05T00:00:00.000Z")},
+	}
+	for name, lines := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "nested"), 0o755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+
+	u, err := NewFileUpstream(dir)
+	if err != nil {
+		t.Fatalf("failed to create upstream: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		after  string
+		count  int
+		expect string
+	}{
+		{"from the start", "", 3, "a,b,c"},
+		{"following page", "2024-01-03T00:00:00.000Z", 3, "d"},
+		{"caught up", "2024-01-04T00:00:00.000Z", 3, ""},
+		{"unrelated cursor", "2024-01-01T00:00:00.000Z", 2, "b,c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(exportCids(t, u, tt.after, tt.count), ","); got != tt.expect {
+				t.Fatalf("expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestFileUpstreamPartialLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.jsonl")
+
+	first := fileLine("a", "2024-01-01T00:00:00.000Z")
+	second := fileLine("b", "2024-01-02T00:00:00.000Z")
+
+	// the dump is still being written, so the last line is cut off part way
+	if err := os.WriteFile(path, []byte(first+"\n"+second[:20]), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	u, err := NewFileUpstream(path)
+	if err != nil {
+		t.Fatalf("failed to create upstream: %v", err)
+	}
+
+	if got := strings.Join(exportCids(t, u, "", 10), ","); got != "a" {
+		t.Fatalf("expected only the complete line, got %q", got)
+	}
+
+	if got := exportCids(t, u, "2024-01-01T00:00:00.000Z", 10); len(got) != 0 {
+		t.Fatalf("expected nothing until the line is finished, got %v", got)
+	}
+
+	// a finished last line is read even without a trailing newline
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	if _, err := f.WriteString(second[20:]); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	f.Close()
+
+	if got := strings.Join(exportCids(t, u, "2024-01-01T00:00:00.000Z", 10), ","); got != "b" {
+		t.Fatalf("expected the finished line, got %q", got)
+	}
+}
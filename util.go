@@ -2,8 +2,10 @@ package mirage
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/crypto"
 	"github.com/mr-tron/base58"
@@ -111,3 +113,35 @@ func formatKeyAndContext(key string) (*keyAndContext, error) {
 		PublicKeyMultibase: strings.TrimPrefix(key, didKeyPrefix),
 	}, nil
 }
+
+// marshalJSONNoEscape behaves like json.Marshal, but does not escape HTML characters. plc.directory
+// does not escape them either, so we need this to keep exports byte-compatible.
+func marshalJSONNoEscape(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// normalizeCreatedAt formats a timestamp the same way that plc.directory formats createdAt, so
+// that it may be compared against the created_at column.
+func normalizeCreatedAt(ts string) (string, error) {
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return "", err
+	}
+
+	return t.UTC().Format(createdAtFormat), nil
+}
+
+func stringsToAny(strs []string) []any {
+	out := make([]any, len(strs))
+	for i, s := range strs {
+		out[i] = s
+	}
+	return out
+}
@@ -0,0 +1,399 @@
+package mirage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+var (
+	// ErrInvalidOperation is wrapped by every error that means an operation failed verification, as
+	// opposed to verification being unable to complete
+	ErrInvalidOperation = errors.New("invalid operation")
+	ErrInvalidSignature = fmt.Errorf("%w: signature is not valid for any rotation key", ErrInvalidOperation)
+	ErrPrevNotFound     = fmt.Errorf("%w: prev operation not found", ErrInvalidOperation)
+	ErrDidMismatch      = fmt.Errorf("%w: did does not match genesis operation", ErrInvalidOperation)
+	ErrCidMismatch      = fmt.Errorf("%w: cid does not match operation", ErrInvalidOperation)
+	ErrPrevNotEarlier   = fmt.Errorf("%w: prev operation was not created before operation", ErrInvalidOperation)
+	ErrRecoveryWindow   = fmt.Errorf("%w: recovery operation is outside of the recovery window", ErrInvalidOperation)
+	ErrRecoveryKey      = fmt.Errorf("%w: recovery operation was not signed by a higher priority rotation key", ErrInvalidOperation)
+
+	// operations may only be nullified by a recovery operation within this window
+	recoveryWindow = 72 * time.Hour
+
+	plcDidPrefix = "did:plc:"
+)
+
+// cborMap returns the operation in the generic shape that is used for DAG-CBOR encoding. The sig
+// is left out when includeSig is false, which is the shape of the data that actually gets signed.
+func (o *PlcOperationType) cborMap(includeSig bool) (map[string]any, error) {
+	var out map[string]any
+	var sig string
+
+	if o.PlcOperation != nil {
+		op := o.PlcOperation
+
+		services := map[string]any{}
+		for id, svc := range op.Services {
+			services[id] = map[string]any{
+				"type":     svc.Type,
+				"endpoint": svc.Endpoint,
+			}
+		}
+
+		vms := map[string]any{}
+		for id, key := range op.VerificationMethods {
+			vms[id] = key
+		}
+
+		out = map[string]any{
+			"type":                op.Type,
+			"services":            services,
+			"alsoKnownAs":         stringsToAny(op.AlsoKnownAs),
+			"rotationKeys":        stringsToAny(op.RotationKeys),
+			"verificationMethods": vms,
+			"prev":                nil,
+		}
+		if op.Prev != nil {
+			out["prev"] = *op.Prev
+		}
+		sig = op.Sig
+	} else if o.PlcTombstone != nil {
+		op := o.PlcTombstone
+		out = map[string]any{
+			"type": op.Type,
+			"prev": op.Prev,
+		}
+		sig = op.Sig
+	} else if o.LegacyPlcOperation != nil {
+		op := o.LegacyPlcOperation
+		out = map[string]any{
+			"type":        op.Type,
+			"handle":      op.Handle,
+			"service":     op.Service,
+			"signingKey":  op.SigningKey,
+			"recoveryKey": op.RecoveryKey,
+			"prev":        nil,
+		}
+		if op.Prev != nil {
+			out["prev"] = *op.Prev
+		}
+		sig = op.Sig
+	} else {
+		return nil, errors.New("operation is empty")
+	}
+
+	if includeSig {
+		out["sig"] = sig
+	}
+
+	return out, nil
+}
+
+// UnsignedBytes returns the DAG-CBOR encoding of the operation without its sig
+func (o *PlcOperationType) UnsignedBytes() ([]byte, error) {
+	obj, err := o.cborMap(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return data.MarshalCBOR(obj)
+}
+
+// SignedBytes returns the DAG-CBOR encoding of the operation including its sig
+func (o *PlcOperationType) SignedBytes() ([]byte, error) {
+	obj, err := o.cborMap(true)
+	if err != nil {
+		return nil, err
+	}
+
+	return data.MarshalCBOR(obj)
+}
+
+func (o *PlcOperationType) Sig() string {
+	if o.PlcOperation != nil {
+		return o.PlcOperation.Sig
+	} else if o.PlcTombstone != nil {
+		return o.PlcTombstone.Sig
+	} else if o.LegacyPlcOperation != nil {
+		return o.LegacyPlcOperation.Sig
+	}
+
+	return ""
+}
+
+// Prev returns the cid of the operation that this operation follows, or nil for a genesis operation
+func (o *PlcOperationType) Prev() *string {
+	if o.PlcOperation != nil {
+		return o.PlcOperation.Prev
+	} else if o.PlcTombstone != nil {
+		return &o.PlcTombstone.Prev
+	} else if o.LegacyPlcOperation != nil {
+		return o.LegacyPlcOperation.Prev
+	}
+
+	return nil
+}
+
+// RotationKeys returns the keys that are allowed to sign the operation that follows this one.
+// Legacy operations list the recovery key ahead of the signing key, as plc.directory does.
+func (o *PlcOperationType) RotationKeys() []string {
+	if op := o.Normalized(); op != nil {
+		return op.RotationKeys
+	}
+
+	return nil
+}
+
+// Cid computes the CIDv1 (dag-cbor, sha256) of the signed operation
+func (o *PlcOperationType) Cid() (cid.Cid, error) {
+	signed, err := o.SignedBytes()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return cid.V1Builder{Codec: cid.DagCBOR, MhType: multihash.SHA2_256}.Sum(signed)
+}
+
+// verifyCid checks that the advertised cid of an entry is the cid of its operation
+func (e *PlcEntry) verifyCid() error {
+	advertised, err := cid.Decode(e.Cid)
+	if err != nil {
+		return fmt.Errorf("%w: failed to decode cid: %s", ErrInvalidOperation, err)
+	}
+
+	computed, err := e.Operation.Cid()
+	if err != nil {
+		return fmt.Errorf("%w: failed to compute cid: %s", ErrInvalidOperation, err)
+	}
+
+	if !computed.Equals(advertised) {
+		return ErrCidMismatch
+	}
+
+	return nil
+}
+
+// GenesisDid computes the did:plc identifier that the operation would create if it were the genesis
+// operation: the first 24 characters of the base32 encoded sha256 of the signed operation
+func (o *PlcOperationType) GenesisDid() (string, error) {
+	signed, err := o.SignedBytes()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(signed)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:])
+
+	return plcDidPrefix + strings.ToLower(enc[:24]), nil
+}
+
+// verifySig checks that the operation was signed by one of the supplied rotation keys, returning
+// the index of the key that signed it
+func (o *PlcOperationType) verifySig(rotationKeys []string) (int, error) {
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(o.Sig(), "="))
+	if err != nil {
+		return -1, fmt.Errorf("%w: failed to decode sig: %s", ErrInvalidOperation, err)
+	}
+
+	unsigned, err := o.UnsignedBytes()
+	if err != nil {
+		return -1, fmt.Errorf("%w: failed to encode operation: %s", ErrInvalidOperation, err)
+	}
+
+	for i, rk := range rotationKeys {
+		pub, err := crypto.ParsePublicDIDKey(rk)
+		if err != nil {
+			continue
+		}
+
+		// some older operations have high-s signatures, so we need to be lenient here
+		if err := pub.HashAndVerifyLenient(unsigned, sig); err == nil {
+			return i, nil
+		}
+	}
+
+	return -1, ErrInvalidSignature
+}
+
+// verifyEntry checks the signature of an entry against the rotation keys of the operation it
+// follows, or against its own rotation keys if it is a genesis operation. Genesis operations must
+// also hash to the did they claim to create, and every other operation must follow an earlier valid
+// operation for the same did, so that each did has a validated chain of operations.
+func (s *entryStore) verifyEntry(entry *PlcEntry) error {
+	createdAt, err := time.Parse(time.RFC3339Nano, entry.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("%w: failed to parse created at: %s", ErrInvalidOperation, err)
+	}
+
+	if err := entry.verifyCid(); err != nil {
+		return err
+	}
+
+	prev := entry.Operation.Prev()
+	if prev == nil {
+		if entry.Operation.PlcTombstone != nil {
+			return fmt.Errorf("%w: tombstone cannot be a genesis operation", ErrInvalidOperation)
+		}
+
+		if _, err := entry.Operation.verifySig(entry.Operation.RotationKeys()); err != nil {
+			return err
+		}
+
+		did, err := entry.Operation.GenesisDid()
+		if err != nil {
+			return fmt.Errorf("%w: failed to compute did: %s", ErrInvalidOperation, err)
+		}
+
+		if did != entry.Did {
+			return ErrDidMismatch
+		}
+
+		return nil
+	}
+
+	prevEntry, err := s.getEntry(entry.Did, *prev)
+	if err != nil {
+		return fmt.Errorf("failed to get prev operation: %w", err)
+	}
+
+	if prevEntry == nil {
+		return ErrPrevNotFound
+	}
+
+	if prevEntry.CreatedAt >= entry.CreatedAt {
+		return ErrPrevNotEarlier
+	}
+
+	rotationKeys := prevEntry.Operation.RotationKeys()
+	keyIdx, err := entry.Operation.verifySig(rotationKeys)
+	if err != nil {
+		return err
+	}
+
+	// an operation that has been nullified is only checked against its prev, since the recovery
+	// operation that nullified it was checked in turn
+	if entry.Nullified {
+		return nil
+	}
+
+	forked, err := s.firstCanonicalBetween(entry.Did, prevEntry.CreatedAt, entry.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to get forked operations: %w", err)
+	}
+
+	if forked == nil {
+		return nil
+	}
+
+	// this operation does not follow the current head of the chain, so it is a recovery operation
+	return checkRecovery(createdAt, keyIdx, forked, rotationKeys)
+}
+
+// checkRecovery checks a recovery operation created at createdAt and signed by rotationKeys[keyIdx]
+// against forked, the first operation that it nullifies. It must be signed by a higher priority key
+// than forked was, and may only nullify operations from within the recovery window.
+func checkRecovery(createdAt time.Time, keyIdx int, forked *PlcEntry, rotationKeys []string) error {
+	forkedAt, err := time.Parse(time.RFC3339Nano, forked.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to parse created at: %w", err)
+	}
+
+	if createdAt.Sub(forkedAt) > recoveryWindow {
+		return ErrRecoveryWindow
+	}
+
+	forkedIdx, err := forked.Operation.verifySig(rotationKeys)
+	if err != nil {
+		return fmt.Errorf("failed to verify forked operation: %w", err)
+	}
+
+	if keyIdx >= forkedIdx {
+		return ErrRecoveryKey
+	}
+
+	return nil
+}
+
+// VerifyAll re-runs verification over every stored entry in created_at order. See verifyRange.
+func (m *Mirage) VerifyAll(ctx context.Context) error {
+	return m.verifyRange(ctx, "", "")
+}
+
+// verifyRange re-runs verification over the stored entries created between from and to (inclusive,
+// with an empty to meaning no end) in created_at order, updating the invalid flag of any entry whose
+// result has changed. Valid recovery operations nullify the operations they fork off, as they do
+// during ingestion. This is used to verify a bulk import, and is useful after verification rules
+// change.
+func (m *Mirage) verifyRange(ctx context.Context, from, to string) error {
+	cursor := from
+	var cursorId uint = 0
+	checked := 0
+	changed := 0
+
+	store := &entryStore{db: m.db.c}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var entries []PlcEntry
+		if err := m.db.c.Raw("SELECT * FROM plc_entries WHERE (created_at, id) > (?, ?) AND (? = '' OR created_at <= ?) ORDER BY created_at ASC, id ASC LIMIT 1000", cursor, cursorId, to, to).Scan(&entries).Error; err != nil {
+			return fmt.Errorf("failed to get entries: %w", err)
+		}
+
+		if len(entries) == 0 {
+			break
+		}
+
+		for _, entry := range entries {
+			invalid := false
+			reason := ""
+			if err := store.verifyEntry(&entry); err != nil {
+				if !errors.Is(err, ErrInvalidOperation) {
+					return fmt.Errorf("failed to verify entry %s: %w", entry.Cid, err)
+				}
+				invalid = true
+				reason = err.Error()
+			}
+
+			if invalid != entry.Invalid || reason != entry.InvalidReason {
+				if err := m.db.c.Exec("UPDATE plc_entries SET invalid = ?, invalid_reason = ? WHERE id = ?", invalid, reason, entry.ID).Error; err != nil {
+					return fmt.Errorf("failed to update entry %s: %w", entry.Cid, err)
+				}
+
+				if invalid {
+					m.logger.Warn("entry failed verification", "did", entry.Did, "cid", entry.Cid, "err", reason)
+				}
+				changed++
+			}
+
+			if !invalid && !entry.Nullified {
+				if err := store.nullifyForkedOps(&entry); err != nil {
+					return fmt.Errorf("failed to nullify forked ops: %w", err)
+				}
+			}
+		}
+
+		checked += len(entries)
+		cursor = entries[len(entries)-1].CreatedAt
+		cursorId = entries[len(entries)-1].ID
+
+		m.logger.Info("verifying entries", "checked", checked, "changed", changed, "cursor", cursor)
+	}
+
+	m.logger.Info("finished verifying entries", "checked", checked, "changed", changed)
+
+	return nil
+}
@@ -0,0 +1,348 @@
+package mirage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/crypto"
+)
+
+// the legacy create operation and its unsigned DAG-CBOR encoding are the published test vector from
+// did-method-plc, which indigo also tests against
+const (
+	legacyVectorKey = "did:key:zDnaeRSYs7c2NpcNA5NRAUqS8DCkLWDyNLnATi28D6w7no7hX"
+	legacyVectorOp  = `{"type":"create","signingKey":"did:key:zDnaeRSYs7c2NpcNA5NRAUqS8DCkLWDyNLnATi28D6w7no7hX","recoveryKey":"did:key:zDnaeRSYs7c2NpcNA5NRAUqS8DCkLWDyNLnATi28D6w7no7hX","handle":"why.bsky.social","service":"bsky.social","prev":null,"sig":"e8h6dCx405Z_95cZWWkZtfLgDPvfdXDG9pCZQi1NhduooZgb4d1w-CzahA3J-iNGCCgP3D0O5l997G3vQfxKOA"}`
+
+	legacyVectorUnsigned = "pmRwcmV29mR0eXBlZmNyZWF0ZWZoYW5kbGVvd2h5LmJza3kuc29jaWFsZ3NlcnZpY2VrYnNreS5zb2NpYWxqc2lnbmluZ0tleXg5ZGlkOmtleTp6RG5hZVJTWXM3YzJOcGNOQTVOUkFVcVM4RENrTFdEeU5MbkFUaTI4RDZ3N25vN2hYa3JlY292ZXJ5S2V5eDlkaWQ6a2V5OnpEbmFlUlNZczdjMk5wY05BNU5SQVVxUzhEQ2tMV0R5TkxuQVRpMjhENnc3bm83aFg"
+)
+
+func unmarshalOp(t *testing.T, raw string) *PlcOperationType {
+	t.Helper()
+
+	var op PlcOperationType
+	if err := json.Unmarshal([]byte(raw), &op); err != nil {
+		t.Fatalf("failed to unmarshal operation: %v", err)
+	}
+
+	return &op
+}
+
+func TestUnsignedBytesLegacyVector(t *testing.T) {
+	op := unmarshalOp(t, legacyVectorOp)
+
+	expected, err := base64.RawURLEncoding.DecodeString(legacyVectorUnsigned)
+	if err != nil {
+		t.Fatalf("failed to decode vector: %v", err)
+	}
+
+	unsigned, err := op.UnsignedBytes()
+	if err != nil {
+		t.Fatalf("failed to encode operation: %v", err)
+	}
+
+	if !bytes.Equal(unsigned, expected) {
+		t.Fatalf("expected %x, got %x", expected, unsigned)
+	}
+
+	// the signed encoding is the same map with the sig added, which sorts first as the shortest key
+	signed, err := op.SignedBytes()
+	if err != nil {
+		t.Fatalf("failed to encode operation: %v", err)
+	}
+
+	sig := op.Sig()
+	expected = append([]byte{0xa7, 0x63, 's', 'i', 'g', 0x78, byte(len(sig))}, append([]byte(sig), expected[1:]...)...)
+	if !bytes.Equal(signed, expected) {
+		t.Fatalf("expected %x, got %x", expected, signed)
+	}
+}
+
+func TestVerifySigLegacyVector(t *testing.T) {
+	op := unmarshalOp(t, legacyVectorOp)
+
+	idx, err := op.verifySig(op.RotationKeys())
+	if err != nil || idx != 0 {
+		t.Fatalf("expected the recovery key to verify, got %d, %v", idx, err)
+	}
+
+	other, err := crypto.GeneratePrivateKeyK256()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	otherPub, err := other.PublicKey()
+	if err != nil {
+		t.Fatalf("failed to get public key: %v", err)
+	}
+
+	idx, err = op.verifySig([]string{"not a key", otherPub.DIDKey(), legacyVectorKey})
+	if err != nil || idx != 2 {
+		t.Fatalf("expected the third key to verify, got %d, %v", idx, err)
+	}
+
+	if _, err := op.verifySig([]string{otherPub.DIDKey()}); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected an invalid signature, got %v", err)
+	}
+
+	op.LegacyPlcOperation.Handle = "someone.else"
+	if _, err := op.verifySig(op.RotationKeys()); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected a tampered operation to fail, got %v", err)
+	}
+}
+
+func TestVerifySigKeyIndex(t *testing.T) {
+	var keys []*crypto.PrivateKeyK256
+	var rotationKeys []string
+	for range 3 {
+		key, err := crypto.GeneratePrivateKeyK256()
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		pub, err := key.PublicKey()
+		if err != nil {
+			t.Fatalf("failed to get public key: %v", err)
+		}
+
+		keys = append(keys, key)
+		rotationKeys = append(rotationKeys, pub.DIDKey())
+	}
+
+	ops := []*PlcOperationType{
+		{PlcOperation: &PlcOperation{
+			Type:                "plc_operation",
+			Services:            map[string]PlcService{},
+			AlsoKnownAs:         []string{"at://user.test"},
+			RotationKeys:        rotationKeys,
+			VerificationMethods: map[string]string{},
+		}},
+		{PlcTombstone: &PlcTombstone{
+			Type: "plc_tombstone",
+			Prev: "bafyreie43rklbctixgks2oy335aoyx2iiaeicuei26q75uqooydqrumh44",
+		}},
+	}
+
+	for _, op := range ops {
+		unsigned, err := op.UnsignedBytes()
+		if err != nil {
+			t.Fatalf("failed to encode operation: %v", err)
+		}
+
+		for i, key := range keys {
+			sig, err := key.HashAndSign(unsigned)
+			if err != nil {
+				t.Fatalf("failed to sign operation: %v", err)
+			}
+
+			if op.PlcOperation != nil {
+				op.PlcOperation.Sig = base64.RawURLEncoding.EncodeToString(sig)
+			} else {
+				op.PlcTombstone.Sig = base64.RawURLEncoding.EncodeToString(sig)
+			}
+
+			idx, err := op.verifySig(rotationKeys)
+			if err != nil || idx != i {
+				t.Fatalf("expected key %d to verify, got %d, %v", i, idx, err)
+			}
+		}
+	}
+}
+
+// fixture operations in the shape plc.directory exports. Their sigs are placeholders, and the
+// expected cids and dids were computed with a separate DAG-CBOR encoder that reproduces the legacy
+// vector's bytes.
+const (
+	genesisFixtureOp   = `{"sig":"c2lnbmF0dXJl","prev":null,"type":"plc_operation","services":{"atproto_pds":{"type":"AtprotoPersonalDataServer","endpoint":"https://bsky.social"}},"alsoKnownAs":["at://why.bsky.social"],"rotationKeys":["did:key:zDnaeRSYs7c2NpcNA5NRAUqS8DCkLWDyNLnATi28D6w7no7hX","did:key:zQ3shXjHeiBuRCKmM36cuYnm7YEMzhGnCmCyW92sRJ9pribSF"],"verificationMethods":{"atproto":"did:key:zQ3shXjHeiBuRCKmM36cuYnm7YEMzhGnCmCyW92sRJ9pribSF"}}`
+	updateFixtureOp    = `{"sig":"c2lnbmF0dXJl","prev":"bafyreifdlioh3ecyvkpkpcvzl4btoclj7znqb3zxy6xzpemlx662cypqjq","type":"plc_operation","services":{"atproto_pds":{"type":"AtprotoPersonalDataServer","endpoint":"https://bsky.social"}},"alsoKnownAs":["at://why.bsky.social"],"rotationKeys":["did:key:zDnaeRSYs7c2NpcNA5NRAUqS8DCkLWDyNLnATi28D6w7no7hX","did:key:zQ3shXjHeiBuRCKmM36cuYnm7YEMzhGnCmCyW92sRJ9pribSF"],"verificationMethods":{"atproto":"did:key:zQ3shXjHeiBuRCKmM36cuYnm7YEMzhGnCmCyW92sRJ9pribSF"}}`
+	tombstoneFixtureOp = `{"sig":"c2lnbmF0dXJl","prev":"bafyreibdk5xshofv3nnyveodfe2reke6n6qmbexu5qgighei3fkxkv4ktm","type":"plc_tombstone"}`
+)
+
+func TestGenesisDid(t *testing.T) {
+	tests := []struct {
+		name   string
+		op     string
+		expect string
+	}{
+		{"legacy vector", legacyVectorOp, "did:plc:unnby7mqlcvj5j4kxfpqgnyj"},
+		{"plc operation", genesisFixtureOp, "did:plc:ttofjmeknc4zklj3dppub3c7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			did, err := unmarshalOp(t, tt.op).GenesisDid()
+			if err != nil {
+				t.Fatalf("failed to compute did: %v", err)
+			}
+
+			if did != tt.expect {
+				t.Fatalf("expected %s, got %s", tt.expect, did)
+			}
+		})
+	}
+}
+
+func TestVerifyEntryGenesis(t *testing.T) {
+	store := &entryStore{byCid: map[string]*PlcEntry{}}
+
+	_, entry := newTestIdentity(t, time.Now(), "user.test")
+	if err := store.verifyEntry(entry); err != nil {
+		t.Fatalf("expected a valid genesis operation, got %v", err)
+	}
+
+	_, other := newTestIdentity(t, time.Now(), "other.test")
+	entry.Did = other.Did
+	if err := store.verifyEntry(entry); !errors.Is(err, ErrDidMismatch) {
+		t.Fatalf("expected a did mismatch, got %v", err)
+	}
+}
+
+func TestCid(t *testing.T) {
+	tests := []struct {
+		name   string
+		op     string
+		expect string
+	}{
+		{"legacy vector", legacyVectorOp, "bafyreifdlioh3ecyvkpkpcvzl4btoclj7znqb3zxy6xzpemlx662cypqjq"},
+		{"plc operation", genesisFixtureOp, "bafyreie43rklbctixgks2oy335aoyx2iiaeicuei26q75uqooydqrumh44"},
+		{"plc operation with prev", updateFixtureOp, "bafyreibdk5xshofv3nnyveodfe2reke6n6qmbexu5qgighei3fkxkv4ktm"},
+		{"tombstone", tombstoneFixtureOp, "bafyreibjqqsdpoxp3m2aiuedqxpybnes23ciymrh72iuvgjmqq7ym7zxpi"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &PlcEntry{Operation: *unmarshalOp(t, tt.op), Cid: tt.expect}
+			if err := entry.verifyCid(); err != nil {
+				t.Fatalf("expected %s, got %v", tt.expect, err)
+			}
+		})
+	}
+}
+
+func TestVerifyEntryPrev(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+
+	id, genesis := newTestIdentity(t, start, "user.test")
+	update := id.update(t, start.Add(time.Second), "new.test")
+	_, other := newTestIdentity(t, start, "other.test")
+
+	// the store has no db, so every lookup has to be answered by the preloaded entries
+	newStore := func() *entryStore {
+		return &entryStore{
+			byCid:  map[string]*PlcEntry{},
+			stored: map[string]*PlcEntry{genesis.Cid: genesis, update.Cid: nil, other.Cid: other},
+			latest: map[string]*PlcEntry{id.did: genesis},
+		}
+	}
+
+	if err := newStore().verifyEntry(update); err != nil {
+		t.Fatalf("expected a valid update, got %v", err)
+	}
+
+	// an update has to follow an operation for the same did
+	forged := *update
+	forged.Did = other.Did
+	if err := newStore().verifyEntry(&forged); !errors.Is(err, ErrPrevNotFound) {
+		t.Fatalf("expected the prev to be missing, got %v", err)
+	}
+
+	store := newStore()
+	store.stored[genesis.Cid] = &PlcEntry{Did: genesis.Did, Operation: genesis.Operation, Cid: genesis.Cid, Invalid: true}
+	if err := store.verifyEntry(update); !errors.Is(err, ErrPrevNotFound) {
+		t.Fatalf("expected an invalid prev to be ignored, got %v", err)
+	}
+
+	early := *update
+	early.CreatedAt = genesis.CreatedAt
+	if err := newStore().verifyEntry(&early); !errors.Is(err, ErrPrevNotEarlier) {
+		t.Fatalf("expected the prev to be too late, got %v", err)
+	}
+
+	// the cid is checked before anything else
+	mismatched := *update
+	mismatched.Cid = genesis.Cid
+	if err := newStore().verifyEntry(&mismatched); !errors.Is(err, ErrCidMismatch) {
+		t.Fatalf("expected a cid mismatch, got %v", err)
+	}
+}
+
+// signWith signs a copy of op with key
+func signWith(t *testing.T, key *crypto.PrivateKeyK256, op PlcOperation) PlcOperationType {
+	t.Helper()
+
+	signed := PlcOperationType{PlcOperation: &op}
+
+	unsigned, err := signed.UnsignedBytes()
+	if err != nil {
+		t.Fatalf("failed to encode operation: %v", err)
+	}
+
+	sig, err := key.HashAndSign(unsigned)
+	if err != nil {
+		t.Fatalf("failed to sign operation: %v", err)
+	}
+	op.Sig = base64.RawURLEncoding.EncodeToString(sig)
+
+	return signed
+}
+
+func TestCheckRecovery(t *testing.T) {
+	var keys []*crypto.PrivateKeyK256
+	var rotationKeys []string
+	for range 2 {
+		key, err := crypto.GeneratePrivateKeyK256()
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		pub, err := key.PublicKey()
+		if err != nil {
+			t.Fatalf("failed to get public key: %v", err)
+		}
+
+		keys = append(keys, key)
+		rotationKeys = append(rotationKeys, pub.DIDKey())
+	}
+
+	prev := "bafyreie43rklbctixgks2oy335aoyx2iiaeicuei26q75uqooydqrumh44"
+	op := PlcOperation{
+		Prev:                &prev,
+		Type:                "plc_operation",
+		Services:            map[string]PlcService{},
+		AlsoKnownAs:         []string{"at://user.test"},
+		RotationKeys:        rotationKeys,
+		VerificationMethods: map[string]string{},
+	}
+
+	forkedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+
+	tests := []struct {
+		name      string
+		forkedBy  int
+		recovered int
+		after     time.Duration
+		expect    error
+	}{
+		{"higher priority key", 1, 0, time.Hour, nil},
+		{"same key", 1, 1, time.Hour, ErrRecoveryKey},
+		{"lower priority key", 0, 1, time.Hour, ErrRecoveryKey},
+		{"top key cannot recover itself", 0, 0, time.Hour, ErrRecoveryKey},
+		{"inside the window", 1, 0, 71 * time.Hour, nil},
+		{"end of the window", 1, 0, recoveryWindow, nil},
+		{"outside the window", 1, 0, 73 * time.Hour, ErrRecoveryWindow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forked := &PlcEntry{
+				Operation: signWith(t, keys[tt.forkedBy], op),
+				CreatedAt: forkedAt.Format(createdAtFormat),
+			}
+
+			err := checkRecovery(forkedAt.Add(tt.after), tt.recovered, forked, rotationKeys)
+			if !errors.Is(err, tt.expect) {
+				t.Fatalf("expected %v, got %v", tt.expect, err)
+			}
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package mirage
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/labstack/echo/v4"
@@ -25,9 +28,35 @@ func (m *Mirage) handleGetDidFromHandle(e echo.Context) error {
 		return e.JSON(404, createError("handle not found in cache. it may exist, but we are not tracking it."))
 	}
 
+	if e.QueryParam("verify") == "true" {
+		hv, err := m.VerifyHandle(handle, *did)
+		if err != nil {
+			return e.JSON(500, createError(err.Error()))
+		}
+
+		return e.JSON(200, hv)
+	}
+
 	return e.String(200, *did)
 }
 
+func (m *Mirage) handleResolveHandle(e echo.Context) error {
+	handle := e.QueryParam("handle")
+
+	if _, err := syntax.ParseHandle(handle); err != nil {
+		return e.JSON(http.StatusBadRequest, createError("invalid handle"))
+	}
+
+	did, err := m.ResolveHandle(e.Request().Context(), handle)
+	if errors.Is(err, ErrConflictingRecords) {
+		return e.JSON(http.StatusConflict, createError(err.Error()))
+	} else if err != nil {
+		return e.JSON(http.StatusNotFound, createError(err.Error()))
+	}
+
+	return e.JSON(http.StatusOK, map[string]string{"did": did})
+}
+
 func (m *Mirage) handleGetHandleFromDid(e echo.Context) error {
 	did := e.Param("did")
 
@@ -36,13 +65,26 @@ func (m *Mirage) handleGetHandleFromDid(e echo.Context) error {
 		return e.JSON(400, createError("invalid did"))
 	}
 
-	handle, found, err := m.GetHandleFromDid(did)
+	at, err := parseAt(e)
 	if err != nil {
+		return e.JSON(http.StatusBadRequest, createError("invalid at, expected an RFC3339 timestamp"))
+	}
+
+	var handle *string
+	var found bool
+	if at != nil {
+		handle, found, err = m.GetHandleFromDidAt(did, *at)
+	} else {
+		handle, found, err = m.GetHandleFromDid(did)
+	}
+	if errors.Is(err, ErrDidTombstoned) {
+		return e.JSON(http.StatusGone, createTombstonedError(did))
+	} else if err != nil {
 		return e.JSON(500, createError(err.Error()))
 	}
 
 	if !found {
-		return e.JSON(404, createError("did not found"))
+		return e.JSON(http.StatusNotFound, createError(ErrDidNotFound.Error()))
 	}
 
 	return e.String(200, *handle)
@@ -51,8 +93,22 @@ func (m *Mirage) handleGetHandleFromDid(e echo.Context) error {
 func (m *Mirage) handleResolveDid(e echo.Context) error {
 	did := e.Param("didOrHandle")
 
-	res, err := m.ResolveDid(did)
+	at, err := parseAt(e)
 	if err != nil {
+		return e.JSON(http.StatusBadRequest, createError("invalid at, expected an RFC3339 timestamp"))
+	}
+
+	var res *ResolveDidResponse
+	if at != nil {
+		res, err = m.ResolveDidAt(did, *at)
+	} else {
+		res, err = m.ResolveDid(did)
+	}
+	if errors.Is(err, ErrDidNotFound) {
+		return e.JSON(http.StatusNotFound, createError(ErrDidNotFound.Error()))
+	} else if errors.Is(err, ErrDidTombstoned) {
+		return e.JSON(http.StatusGone, createTombstonedError(did))
+	} else if err != nil {
 		return e.JSON(500, createError(err.Error()))
 	}
 
@@ -68,17 +124,15 @@ func (m *Mirage) handleGetPlcOpLog(e echo.Context) error {
 	}
 
 	if len(res) == 0 {
-		return e.JSON(404, createError("no plc op log found"))
+		return e.JSON(http.StatusNotFound, createError(ErrDidNotFound.Error()))
 	}
 
 	ops := make([]interface{}, len(res))
 	for i, op := range res {
-		if op.Operation.PlcOperation != nil {
-			ops[i] = op.Operation.PlcOperation
+		if normalized := op.Operation.Normalized(); normalized != nil {
+			ops[i] = normalized
 		} else if op.Operation.PlcTombstone != nil {
 			ops[i] = op.Operation.PlcTombstone
-		} else if op.Operation.LegacyPlcOperation != nil {
-			ops[i] = op.Operation.LegacyPlcOperation
 		}
 	}
 
@@ -89,20 +143,16 @@ func (m *Mirage) handleGetLastOp(e echo.Context) error {
 	did := e.Param("didOrHandle")
 
 	res, err := m.GetLastOp(did)
-	if err != nil {
+	if errors.Is(err, ErrDidNotFound) {
+		return e.JSON(http.StatusNotFound, createError(ErrDidNotFound.Error()))
+	} else if err != nil {
 		return e.JSON(500, createError(err.Error()))
 	}
 
-	if res == nil {
-		return e.JSON(404, createError("no op found"))
-	}
-
-	if res.Operation.PlcOperation != nil {
-		return e.JSON(200, res.Operation.PlcOperation)
+	if normalized := res.Operation.Normalized(); normalized != nil {
+		return e.JSON(200, normalized)
 	} else if res.Operation.PlcTombstone != nil {
 		return e.JSON(200, res.Operation.PlcTombstone)
-	} else if res.Operation.LegacyPlcOperation != nil {
-		return e.JSON(200, res.Operation.LegacyPlcOperation)
 	}
 
 	return e.JSON(500, createError("unknown"))
@@ -111,13 +161,23 @@ func (m *Mirage) handleGetLastOp(e echo.Context) error {
 func (m *Mirage) handleGetPlcData(e echo.Context) error {
 	did := e.Param("didOrHandle")
 
-	res, err := m.GetPlcData(did)
+	at, err := parseAt(e)
 	if err != nil {
-		return e.JSON(500, createError(err.Error()))
+		return e.JSON(http.StatusBadRequest, createError("invalid at, expected an RFC3339 timestamp"))
 	}
 
-	if res == nil {
-		return e.JSON(404, createError("no op found"))
+	var res *DataResponse
+	if at != nil {
+		res, err = m.GetPlcDataAt(did, *at)
+	} else {
+		res, err = m.GetPlcData(did)
+	}
+	if errors.Is(err, ErrDidNotFound) {
+		return e.JSON(http.StatusNotFound, createError(ErrDidNotFound.Error()))
+	} else if errors.Is(err, ErrDidTombstoned) {
+		return e.JSON(http.StatusGone, createTombstonedError(did))
+	} else if err != nil {
+		return e.JSON(500, createError(err.Error()))
 	}
 
 	return e.JSON(200, res)
@@ -126,13 +186,28 @@ func (m *Mirage) handleGetPlcData(e echo.Context) error {
 func (m *Mirage) handleGetService(e echo.Context) error {
 	did := e.Param("didOrHandle")
 
-	res, found, err := m.GetService(did)
+	at, err := parseAt(e)
 	if err != nil {
+		return e.JSON(http.StatusBadRequest, createError("invalid at, expected an RFC3339 timestamp"))
+	}
+
+	var res *string
+	var found bool
+	if at != nil {
+		res, found, err = m.GetServiceAt(did, *at)
+	} else {
+		res, found, err = m.GetService(did)
+	}
+	if errors.Is(err, ErrDidNotFound) {
+		return e.JSON(http.StatusNotFound, createError(ErrDidNotFound.Error()))
+	} else if errors.Is(err, ErrDidTombstoned) {
+		return e.JSON(http.StatusGone, createTombstonedError(did))
+	} else if err != nil {
 		return e.JSON(500, createError(err.Error()))
 	}
 
 	if !found {
-		return e.JSON(404, createError("no op found"))
+		return e.JSON(404, createError("no pds service found"))
 	}
 
 	return e.String(200, *res)
@@ -141,13 +216,13 @@ func (m *Mirage) handleGetService(e echo.Context) error {
 func (m *Mirage) handleGetAuditLog(e echo.Context) error {
 	did := e.Param("didOrHandle")
 
-	res, err := m.GetPlcOpLog(did)
+	res, err := m.GetAuditLog(did)
 	if err != nil {
 		return e.JSON(500, createError(err.Error()))
 	}
 
 	if len(res) == 0 {
-		return e.JSON(404, createError("no op log found"))
+		return e.JSON(http.StatusNotFound, createError(ErrDidNotFound.Error()))
 	}
 
 	type Entry struct {
@@ -181,6 +256,40 @@ func (m *Mirage) handleGetAuditLog(e echo.Context) error {
 	return e.JSON(200, entries)
 }
 
+func (m *Mirage) handleGetHandleHistory(e echo.Context) error {
+	did := e.Param("didOrHandle")
+
+	res, err := m.GetHandleHistory(did)
+	if err != nil {
+		return e.JSON(500, createError(err.Error()))
+	}
+
+	if len(res) == 0 {
+		return e.JSON(http.StatusNotFound, createError(ErrDidNotFound.Error()))
+	}
+
+	return e.JSON(200, res)
+}
+
+func (m *Mirage) handleGetHandleClaims(e echo.Context) error {
+	handle := e.Param("handle")
+
+	if _, err := syntax.ParseHandle(handle); err != nil {
+		return e.JSON(http.StatusBadRequest, createError("invalid handle"))
+	}
+
+	res, err := m.GetHandleClaims(handle)
+	if err != nil {
+		return e.JSON(500, createError(err.Error()))
+	}
+
+	if len(res) == 0 {
+		return e.JSON(http.StatusNotFound, createError("handle has never been claimed"))
+	}
+
+	return e.JSON(200, res)
+}
+
 func (m *Mirage) handleGetCreatedAt(e echo.Context) error {
 	did := e.Param("didOrHandle")
 
@@ -190,7 +299,7 @@ func (m *Mirage) handleGetCreatedAt(e echo.Context) error {
 	}
 
 	if !found {
-		return e.JSON(400, createError("did not found"))
+		return e.JSON(http.StatusNotFound, createError(ErrDidNotFound.Error()))
 	}
 
 	return e.String(200, *res)
@@ -223,10 +332,86 @@ func (m *Mirage) handleGetDidHandles(e echo.Context) error {
 	})
 }
 
+// parseAt parses the optional at query param, which asks for an answer as of a point in time
+func parseAt(e echo.Context) (*time.Time, error) {
+	astr := e.QueryParam("at")
+	if astr == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, astr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
 func createError(msg string) map[string]string {
 	return map[string]string{"error": msg}
 }
 
+// createTombstonedError mirrors the message that plc.directory returns for a deactivated did, along
+// with enough structure for clients to tell it apart from other errors
+func createTombstonedError(did string) map[string]string {
+	return map[string]string{
+		"message": fmt.Sprintf("DID not available: %s", did),
+		"did":     did,
+		"status":  "tombstoned",
+	}
+}
+
 func (m *Mirage) handleExport(e echo.Context) error {
-	return e.String(501, "this route is not implemented. to export the plc, use https://plc.directory/export")
+	count := exportDefaultCount
+	if cstr := e.QueryParam("count"); cstr != "" {
+		c, err := strconv.Atoi(cstr)
+		if err != nil || c < 1 {
+			return e.JSON(http.StatusBadRequest, createError("invalid count"))
+		}
+
+		if c > exportMaxCount {
+			return e.JSON(http.StatusBadRequest, createError(fmt.Sprintf("count may not exceed %d", exportMaxCount)))
+		}
+
+		count = c
+	}
+
+	after := ""
+	if astr := e.QueryParam("after"); astr != "" {
+		a, err := normalizeCreatedAt(astr)
+		if err != nil {
+			return e.JSON(http.StatusBadRequest, createError("invalid after"))
+		}
+		after = a
+	}
+
+	entries, err := m.GetExport(after, count)
+	if err != nil {
+		return e.JSON(http.StatusInternalServerError, createError(err.Error()))
+	}
+
+	resp := e.Response()
+	resp.Header().Set(echo.HeaderContentType, "application/jsonlines")
+	resp.WriteHeader(http.StatusOK)
+
+	// plc.directory separates entries with a newline but does not include a trailing one
+	for i, entry := range entries {
+		b, err := marshalJSONNoEscape(entry)
+		if err != nil {
+			m.logger.Error("failed to marshal export entry", "cid", entry.Cid, "err", err)
+			return nil
+		}
+
+		if i > 0 {
+			b = append([]byte("\n"), b...)
+		}
+
+		if _, err := resp.Write(b); err != nil {
+			return nil
+		}
+	}
+
+	resp.Flush()
+
+	return nil
 }
@@ -0,0 +1,190 @@
+package mirage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMissingAndTombstoned(t *testing.T) {
+	m, _ := newTestMirage(t, nil)
+
+	unknownDid := "did:plc:aaaaaaaaaaaaaaaaaaaaaaaa"
+	unknownHandle := "nobody.test"
+	tombstonedDid := "did:plc:bbbbbbbbbbbbbbbbbbbbbbbb"
+
+	prev := "bafyreigenesis"
+	entries := []PlcEntry{
+		{
+			Did: tombstonedDid,
+			Cid: prev,
+			Operation: PlcOperationType{PlcOperation: &PlcOperation{
+				Sig:         "sig",
+				Type:        "plc_operation",
+				AlsoKnownAs: []string{"at://gone.test"},
+				Services: map[string]PlcService{
+					atprotoPdsService: {Type: atprotoPdsServiceType, Endpoint: "https://pds.test"},
+				},
+			}},
+			CreatedAt: "2024-01-01T00:00:00.000Z",
+		},
+		{
+			Did: tombstonedDid,
+			Cid: "bafyreitombstone",
+			Operation: PlcOperationType{PlcTombstone: &PlcTombstone{
+				Sig:  "sig",
+				Prev: prev,
+				Type: "plc_tombstone",
+			}},
+			CreatedAt: "2024-01-02T00:00:00.000Z",
+		},
+	}
+	if err := m.db.c.Create(&entries).Error; err != nil {
+		t.Fatalf("failed to create entries: %v", err)
+	}
+
+	if err := m.db.c.Create(&DidHandle{Did: tombstonedDid, Handle: "gone.test", UpdatedAt: time.Now(), Tombstoned: true}).Error; err != nil {
+		t.Fatalf("failed to create did handle: %v", err)
+	}
+
+	router := m.newRouter(&MirageServerArgs{})
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"unknown did doc", "/" + unknownDid, http.StatusNotFound},
+		{"unknown did data", "/" + unknownDid + "/data", http.StatusNotFound},
+		{"unknown did service", "/service/" + unknownDid, http.StatusNotFound},
+		{"unknown did log", "/" + unknownDid + "/log", http.StatusNotFound},
+		{"unknown did last op", "/" + unknownDid + "/log/last", http.StatusNotFound},
+		{"unknown did handle", "/handle/" + unknownDid, http.StatusNotFound},
+		{"unknown did created", "/created/" + unknownDid, http.StatusNotFound},
+
+		{"unknown handle doc", "/" + unknownHandle, http.StatusNotFound},
+		{"unknown handle data", "/" + unknownHandle + "/data", http.StatusNotFound},
+		{"unknown handle service", "/service/" + unknownHandle, http.StatusNotFound},
+		{"unknown handle log", "/" + unknownHandle + "/log", http.StatusNotFound},
+		{"unknown handle last op", "/" + unknownHandle + "/log/last", http.StatusNotFound},
+		{"unknown handle did", "/did/" + unknownHandle, http.StatusNotFound},
+		{"unknown handle created", "/created/" + unknownHandle, http.StatusNotFound},
+		// /handle only takes a did
+		{"handle instead of did", "/handle/" + unknownHandle, http.StatusBadRequest},
+
+		{"tombstoned doc", "/" + tombstonedDid, http.StatusGone},
+		{"tombstoned data", "/" + tombstonedDid + "/data", http.StatusGone},
+		{"tombstoned service", "/service/" + tombstonedDid, http.StatusGone},
+		{"tombstoned handle", "/handle/" + tombstonedDid, http.StatusGone},
+		// the log of a tombstoned did is still served, ending with the tombstone
+		{"tombstoned log", "/" + tombstonedDid + "/log", http.StatusOK},
+		{"tombstoned last op", "/" + tombstonedDid + "/log/last", http.StatusOK},
+		{"tombstoned created", "/created/" + tombstonedDid, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+
+			switch tt.status {
+			case http.StatusNotFound, http.StatusBadRequest:
+				var body map[string]string
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+					t.Fatalf("failed to unmarshal body: %v", err)
+				}
+
+				if body["error"] == "" {
+					t.Fatalf("expected an error message, got %s", rec.Body.String())
+				}
+			case http.StatusGone:
+				var body map[string]string
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+					t.Fatalf("failed to unmarshal body: %v", err)
+				}
+
+				if expected := "DID not available: " + tombstonedDid; body["message"] != expected {
+					t.Fatalf("expected message %q, got %q", expected, body["message"])
+				}
+			}
+		})
+	}
+
+	t.Run("tombstoned last op is the tombstone", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+tombstonedDid+"/log/last", nil))
+
+		var op PlcTombstone
+		if err := json.Unmarshal(rec.Body.Bytes(), &op); err != nil {
+			t.Fatalf("failed to unmarshal body: %v", err)
+		}
+
+		if op.Type != "plc_tombstone" || op.Prev != prev {
+			t.Fatalf("expected the tombstone, got %s", rec.Body.String())
+		}
+	})
+}
+
+func TestResolveHandleAt(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+
+	first, firstGenesis := newTestIdentity(t, start, "moved.test")
+	firstUpdate := first.update(t, start.Add(time.Minute), "elsewhere.test")
+	second, secondGenesis := newTestIdentity(t, start.Add(2*time.Minute), "moved.test")
+
+	m, _ := newTestMirage(t, nil)
+
+	if _, err := m.ingestPage(pageOf(t, firstGenesis, firstUpdate, secondGenesis), ""); err != nil {
+		t.Fatalf("failed to ingest page: %v", err)
+	}
+
+	router := m.newRouter(&MirageServerArgs{})
+
+	tests := []struct {
+		name   string
+		at     string
+		status int
+		did    string
+	}{
+		{"current", "", http.StatusOK, second.did},
+		{"before anyone claimed it", start.Add(-time.Minute).UTC().Format(time.RFC3339), http.StatusNotFound, ""},
+		{"first claim", start.Add(30 * time.Second).UTC().Format(time.RFC3339), http.StatusOK, first.did},
+		{"between claims", start.Add(90 * time.Second).UTC().Format(time.RFC3339), http.StatusNotFound, ""},
+		{"second claim", start.Add(3 * time.Minute).UTC().Format(time.RFC3339), http.StatusOK, second.did},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/moved.test"
+			if tt.at != "" {
+				path += "?at=" + tt.at
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var doc ResolveDidResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+				t.Fatalf("failed to unmarshal body: %v", err)
+			}
+
+			if doc.Id != tt.did {
+				t.Fatalf("expected %s, got %s", tt.did, doc.Id)
+			}
+		})
+	}
+}
@@ -0,0 +1,471 @@
+package mirage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+var (
+	WebhookEventHandle    = "handle"
+	WebhookEventPds       = "pds"
+	WebhookEventKey       = "key"
+	WebhookEventTombstone = "tombstone"
+
+	webhookEventTypes = []string{WebhookEventHandle, WebhookEventPds, WebhookEventKey, WebhookEventTombstone}
+
+	webhookPollInterval = 1 * time.Second
+	webhookBatchSize    = 100
+	webhookConcurrency  = 16
+	webhookTimeout      = 10 * time.Second
+
+	// a replica holds its claim on a webhook for at most this long, so a replica that goes away
+	// mid-delivery only holds up that webhook until the claim runs out
+	webhookClaimLease = 5 * time.Minute
+
+	// a delivery is attempted webhookMaxAttempts times, waiting twice as long after each failure
+	webhookMaxAttempts = 12
+	webhookBaseBackoff = 10 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+
+	webhookSignatureHeader = "X-Mirage-Signature"
+	webhookTimestampHeader = "X-Mirage-Timestamp"
+	webhookEventHeader     = "X-Mirage-Event"
+	webhookDeliveryHeader  = "X-Mirage-Delivery"
+)
+
+// IdentityEvent is the payload that is delivered to webhooks. Only the fields that are relevant to
+// the event's type are set.
+type IdentityEvent struct {
+	Type string `json:"type"`
+	Did  string `json:"did"`
+	// Cid and At are the cid and createdAt of the operation that caused the event
+	Cid string `json:"cid"`
+	At  string `json:"at"`
+
+	OldHandle string `json:"oldHandle,omitempty"`
+	NewHandle string `json:"newHandle,omitempty"`
+
+	OldPds string `json:"oldPds,omitempty"`
+	NewPds string `json:"newPds,omitempty"`
+
+	RotationKeys        []string          `json:"rotationKeys,omitempty"`
+	VerificationMethods map[string]string `json:"verificationMethods,omitempty"`
+}
+
+func (w *Webhook) matches(evt *IdentityEvent) bool {
+	if len(w.Events) > 0 && !slices.Contains(w.Events, evt.Type) {
+		return false
+	}
+
+	if len(w.Dids) > 0 && !slices.Contains(w.Dids, evt.Did) {
+		return false
+	}
+
+	return true
+}
+
+// identityEvents compares an entry against the operation it follows and returns an event for each
+// kind of change. prev is nil for a genesis operation, in which case everything the operation sets
+// counts as a change.
+func identityEvents(prev, entry *PlcEntry) []*IdentityEvent {
+	base := IdentityEvent{
+		Did: entry.Did,
+		Cid: entry.Cid,
+		At:  entry.CreatedAt,
+	}
+
+	oldHandle := ""
+	prevOp := &PlcOperation{}
+	if prev != nil {
+		oldHandle, _ = entryHandle(prev)
+		if op := prev.Operation.Normalized(); op != nil {
+			prevOp = op
+		}
+	}
+
+	op := entry.Operation.Normalized()
+	if op == nil {
+		evt := base
+		evt.Type = WebhookEventTombstone
+		evt.OldHandle = oldHandle
+		return []*IdentityEvent{&evt}
+	}
+
+	var evts []*IdentityEvent
+
+	if newHandle, _ := entryHandle(entry); newHandle != oldHandle {
+		evt := base
+		evt.Type = WebhookEventHandle
+		evt.OldHandle = oldHandle
+		evt.NewHandle = newHandle
+		evts = append(evts, &evt)
+	}
+
+	if oldPds, newPds := prevOp.Services[atprotoPdsService].Endpoint, op.Services[atprotoPdsService].Endpoint; oldPds != newPds {
+		evt := base
+		evt.Type = WebhookEventPds
+		evt.OldPds = oldPds
+		evt.NewPds = newPds
+		evts = append(evts, &evt)
+	}
+
+	if !slices.Equal(prevOp.RotationKeys, op.RotationKeys) || !maps.Equal(prevOp.VerificationMethods, op.VerificationMethods) {
+		evt := base
+		evt.Type = WebhookEventKey
+		evt.RotationKeys = op.RotationKeys
+		evt.VerificationMethods = op.VerificationMethods
+		evts = append(evts, &evt)
+	}
+
+	return evts
+}
+
+// enqueueWebhookDeliveries queues a delivery for every webhook that matches an event caused by the
+// valid entries in the store. It runs in the same transaction as the entries are written in, and the
+// store only holds entries that the transaction inserted, so deliveries are queued exactly once for
+// every entry.
+func enqueueWebhookDeliveries(tx *gorm.DB, store *entryStore) error {
+	var webhooks []Webhook
+	if err := tx.Raw("SELECT * FROM webhooks").Scan(&webhooks).Error; err != nil {
+		return fmt.Errorf("failed to get webhooks: %w", err)
+	}
+
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	var deliveries []WebhookDelivery
+	for _, entry := range store.pending {
+		if entry.Invalid || entry.Nullified {
+			continue
+		}
+
+		var prev *PlcEntry
+		if p := entry.Operation.Prev(); p != nil {
+			pe, err := store.getEntry(entry.Did, *p)
+			if err != nil {
+				return fmt.Errorf("failed to get prev operation: %w", err)
+			}
+			prev = pe
+		}
+
+		for _, evt := range identityEvents(prev, entry) {
+			payload, err := marshalJSONNoEscape(evt)
+			if err != nil {
+				return fmt.Errorf("failed to marshal identity event: %w", err)
+			}
+
+			for _, wh := range webhooks {
+				if !wh.matches(evt) {
+					continue
+				}
+
+				deliveries = append(deliveries, WebhookDelivery{
+					WebhookId:     wh.Id,
+					Event:         evt.Type,
+					Payload:       string(payload),
+					NextAttemptAt: now,
+				})
+			}
+		}
+	}
+
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	return tx.CreateInBatches(deliveries, insertBatchSize).Error
+}
+
+// RunWebhookDeliveries starts delivering queued webhook events in the background. It runs until the
+// context passed to NewMirage is cancelled.
+func (m *Mirage) RunWebhookDeliveries() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		client := &http.Client{
+			Timeout: webhookTimeout,
+		}
+
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(webhookPollInterval):
+			}
+
+			if err := m.deliverDueWebhooks(client); err != nil {
+				m.logger.Error("failed to deliver webhooks", "err", err)
+			}
+		}
+	}()
+}
+
+// deliverDueWebhooks attempts the deliveries that are due. Each webhook is claimed by a single
+// replica at a time, and its deliveries are sent in the order they were queued: a delivery that is
+// waiting to be retried holds back every delivery queued after it. Different webhooks are delivered
+// to concurrently so that a slow receiver doesn't hold up the others.
+func (m *Mirage) deliverDueWebhooks(client *http.Client) error {
+	now := time.Now()
+	claimedUntil := now.Add(webhookClaimLease)
+
+	var webhooks []Webhook
+	if err := m.db.c.Raw(`UPDATE webhooks SET claimed_until = ? WHERE id IN (
+		SELECT id FROM webhooks
+		WHERE (claimed_until IS NULL OR claimed_until < ?)
+		AND (SELECT next_attempt_at FROM webhook_deliveries d WHERE d.webhook_id = webhooks.id AND d.delivered_at IS NULL AND d.failed_at IS NULL ORDER BY d.id ASC LIMIT 1) <= ?
+		ORDER BY id ASC LIMIT ? FOR UPDATE SKIP LOCKED
+	) RETURNING *`, claimedUntil, now, now, webhookConcurrency).Scan(&webhooks).Error; err != nil {
+		return fmt.Errorf("failed to claim webhooks: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range webhooks {
+		wh := &webhooks[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := m.deliverWebhook(client, wh, claimedUntil); err != nil {
+				m.logger.Error("failed to deliver webhook", "webhook", wh.Id, "err", err)
+			}
+
+			if err := m.db.c.Exec("UPDATE webhooks SET claimed_until = NULL WHERE id = ? AND claimed_until = ?", wh.Id, claimedUntil).Error; err != nil {
+				m.logger.Error("failed to release webhook", "webhook", wh.Id, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// deliverWebhook sends a claimed webhook's pending deliveries in order, stopping at the first one
+// that isn't due yet or fails, and before the claim runs out
+func (m *Mirage) deliverWebhook(client *http.Client, wh *Webhook, claimedUntil time.Time) error {
+	var deliveries []WebhookDelivery
+	if err := m.db.c.Raw("SELECT * FROM webhook_deliveries WHERE webhook_id = ? AND delivered_at IS NULL AND failed_at IS NULL ORDER BY id ASC LIMIT ?", wh.Id, webhookBatchSize).Scan(&deliveries).Error; err != nil {
+		return fmt.Errorf("failed to get deliveries: %w", err)
+	}
+
+	for i := range deliveries {
+		d := &deliveries[i]
+		if m.ctx.Err() != nil || d.NextAttemptAt.After(time.Now()) || time.Now().Add(webhookTimeout).After(claimedUntil) {
+			return nil
+		}
+
+		if !m.attemptDelivery(client, wh, d) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// attemptDelivery sends a single delivery and records the result, scheduling a retry if it failed.
+// It returns false if the delivery is going to be retried, in which case the deliveries after it
+// have to wait.
+func (m *Mirage) attemptDelivery(client *http.Client, wh *Webhook, d *WebhookDelivery) bool {
+	err := m.sendWebhook(client, wh, d)
+	now := time.Now()
+	attempts := d.Attempts + 1
+
+	var res *gorm.DB
+	if err == nil {
+		res = m.db.c.Exec("UPDATE webhook_deliveries SET attempts = ?, delivered_at = ?, last_error = '' WHERE id = ?", attempts, now, d.Id)
+	} else if attempts >= webhookMaxAttempts {
+		m.logger.Warn("giving up on webhook delivery", "webhook", wh.Id, "delivery", d.Id, "err", err)
+		res = m.db.c.Exec("UPDATE webhook_deliveries SET attempts = ?, failed_at = ?, last_error = ? WHERE id = ?", attempts, now, err.Error(), d.Id)
+	} else {
+		m.logger.Debug("webhook delivery failed", "webhook", wh.Id, "delivery", d.Id, "attempts", attempts, "err", err)
+		res = m.db.c.Exec("UPDATE webhook_deliveries SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?", attempts, now.Add(webhookBackoff(attempts)), err.Error(), d.Id)
+	}
+
+	if res.Error != nil {
+		m.logger.Error("failed to update webhook delivery", "delivery", d.Id, "err", res.Error)
+		return false
+	}
+
+	return err == nil || attempts >= webhookMaxAttempts
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+
+	return backoff
+}
+
+func (m *Mirage) sendWebhook(client *http.Client, wh *Webhook, d *WebhookDelivery) error {
+	payload := []byte(d.Payload)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(m.ctx, "POST", wh.Url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatUint(uint64(d.Id), 10))
+	req.Header.Set(webhookTimestampHeader, ts)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookPayload(wh.Secret, ts, payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned non-2xx status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// signWebhookPayload returns the hex encoded HMAC-SHA256 of "<timestamp>.<payload>". The timestamp
+// is signed along with the payload so that receivers can reject replayed deliveries.
+func signWebhookPayload(secret, ts string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// adminAuthMw requires the admin token as a bearer token
+func adminAuthMw(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(e echo.Context) error {
+			auth := e.Request().Header.Get(echo.HeaderAuthorization)
+			if !hmac.Equal([]byte(auth), []byte("Bearer "+token)) {
+				return e.JSON(http.StatusUnauthorized, createError("unauthorized"))
+			}
+
+			return next(e)
+		}
+	}
+}
+
+type createWebhookRequest struct {
+	Url    string   `json:"url"`
+	Events []string `json:"events"`
+	Dids   []string `json:"dids"`
+}
+
+func (m *Mirage) handleCreateWebhook(e echo.Context) error {
+	var req createWebhookRequest
+	if err := e.Bind(&req); err != nil {
+		return e.JSON(http.StatusBadRequest, createError("invalid request body"))
+	}
+
+	u, err := url.Parse(req.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return e.JSON(http.StatusBadRequest, createError("invalid url"))
+	}
+
+	for _, evt := range req.Events {
+		if !slices.Contains(webhookEventTypes, evt) {
+			return e.JSON(http.StatusBadRequest, createError(fmt.Sprintf("unknown event type %q", evt)))
+		}
+	}
+
+	for _, did := range req.Dids {
+		if _, err := syntax.ParseDID(did); err != nil {
+			return e.JSON(http.StatusBadRequest, createError(fmt.Sprintf("invalid did %q", did)))
+		}
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return e.JSON(http.StatusInternalServerError, createError(err.Error()))
+	}
+
+	wh := Webhook{
+		Url:    req.Url,
+		Secret: secret,
+		Events: req.Events,
+		Dids:   req.Dids,
+	}
+
+	if err := m.db.c.Create(&wh).Error; err != nil {
+		return e.JSON(http.StatusInternalServerError, createError(err.Error()))
+	}
+
+	// this is the only time that the secret is returned
+	return e.JSON(http.StatusCreated, wh)
+}
+
+func (m *Mirage) handleListWebhooks(e echo.Context) error {
+	var webhooks []Webhook
+	if err := m.db.c.Raw("SELECT * FROM webhooks ORDER BY id ASC").Scan(&webhooks).Error; err != nil {
+		return e.JSON(http.StatusInternalServerError, createError(err.Error()))
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	return e.JSON(http.StatusOK, webhooks)
+}
+
+func (m *Mirage) handleDeleteWebhook(e echo.Context) error {
+	id, err := strconv.ParseUint(e.Param("id"), 10, 64)
+	if err != nil {
+		return e.JSON(http.StatusBadRequest, createError("invalid id"))
+	}
+
+	var deleted int64
+	if err := m.db.c.Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec("DELETE FROM webhooks WHERE id = ?", id)
+		if res.Error != nil {
+			return res.Error
+		}
+		deleted = res.RowsAffected
+
+		return tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id).Error
+	}); err != nil {
+		return e.JSON(http.StatusInternalServerError, createError(err.Error()))
+	}
+
+	if deleted == 0 {
+		return e.JSON(http.StatusNotFound, createError("webhook not found"))
+	}
+
+	return e.NoContent(http.StatusNoContent)
+}
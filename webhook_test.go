@@ -0,0 +1,160 @@
+package mirage
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWebhookMatches(t *testing.T) {
+	evt := &IdentityEvent{Type: WebhookEventHandle, Did: "did:plc:a"}
+
+	tests := []struct {
+		name   string
+		wh     Webhook
+		expect bool
+	}{
+		{"no filters", Webhook{}, true},
+		{"event type", Webhook{Events: []string{WebhookEventPds, WebhookEventHandle}}, true},
+		{"other event type", Webhook{Events: []string{WebhookEventPds}}, false},
+		{"did", Webhook{Dids: []string{"did:plc:b", "did:plc:a"}}, true},
+		{"other did", Webhook{Dids: []string{"did:plc:b"}}, false},
+		{"both", Webhook{Events: []string{WebhookEventHandle}, Dids: []string{"did:plc:a"}}, true},
+		{"event type but other did", Webhook{Events: []string{WebhookEventHandle}, Dids: []string{"did:plc:b"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.wh.matches(evt); got != tt.expect {
+				t.Fatalf("expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestIdentityEvents(t *testing.T) {
+	legacy := &PlcEntry{Did: "did:plc:unnby7mqlcvj5j4kxfpqgnyj", Cid: "legacy", Operation: *unmarshalOp(t, legacyVectorOp)}
+
+	// the same document as the legacy operation, in the modern shape
+	op := func(handle, pds string, rotationKeys ...string) *PlcEntry {
+		return &PlcEntry{
+			Did: legacy.Did,
+			Cid: handle + pds,
+			Operation: PlcOperationType{PlcOperation: &PlcOperation{
+				Type: "plc_operation",
+				Services: map[string]PlcService{
+					atprotoPdsService: {Type: atprotoPdsServiceType, Endpoint: pds},
+				},
+				AlsoKnownAs:         []string{"at://" + handle},
+				RotationKeys:        rotationKeys,
+				VerificationMethods: map[string]string{atprotoVerificationMethod: legacyVectorKey},
+			}},
+		}
+	}
+	tombstone := &PlcEntry{Did: legacy.Did, Cid: "tombstone", Operation: *unmarshalOp(t, tombstoneFixtureOp)}
+
+	tests := []struct {
+		name   string
+		prev   *PlcEntry
+		entry  *PlcEntry
+		expect []IdentityEvent
+	}{
+		{
+			name:  "legacy genesis",
+			entry: legacy,
+			expect: []IdentityEvent{
+				{Type: WebhookEventHandle, NewHandle: "why.bsky.social"},
+				{Type: WebhookEventPds, NewPds: "https://bsky.social"},
+				{Type: WebhookEventKey},
+			},
+		},
+		{
+			name:  "legacy converted as is",
+			prev:  legacy,
+			entry: op("why.bsky.social", "https://bsky.social", legacyVectorKey, legacyVectorKey),
+		},
+		{
+			name:   "handle change",
+			prev:   legacy,
+			entry:  op("new.bsky.social", "https://bsky.social", legacyVectorKey, legacyVectorKey),
+			expect: []IdentityEvent{{Type: WebhookEventHandle, OldHandle: "why.bsky.social", NewHandle: "new.bsky.social"}},
+		},
+		{
+			name:   "pds change",
+			prev:   legacy,
+			entry:  op("why.bsky.social", "https://pds.test", legacyVectorKey, legacyVectorKey),
+			expect: []IdentityEvent{{Type: WebhookEventPds, OldPds: "https://bsky.social", NewPds: "https://pds.test"}},
+		},
+		{
+			name:   "rotation key change",
+			prev:   legacy,
+			entry:  op("why.bsky.social", "https://bsky.social", legacyVectorKey),
+			expect: []IdentityEvent{{Type: WebhookEventKey}},
+		},
+		{
+			name:   "tombstone",
+			prev:   legacy,
+			entry:  tombstone,
+			expect: []IdentityEvent{{Type: WebhookEventTombstone, OldHandle: "why.bsky.social"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evts := identityEvents(tt.prev, tt.entry)
+			if len(evts) != len(tt.expect) {
+				t.Fatalf("expected %d events, got %+v", len(tt.expect), evts)
+			}
+
+			for i, evt := range evts {
+				expect := tt.expect[i]
+				if evt.Type != expect.Type || evt.OldHandle != expect.OldHandle || evt.NewHandle != expect.NewHandle || evt.OldPds != expect.OldPds || evt.NewPds != expect.NewPds {
+					t.Fatalf("expected %+v, got %+v", expect, *evt)
+				}
+
+				if evt.Did != tt.entry.Did || evt.Cid != tt.entry.Cid {
+					t.Fatalf("expected the event to reference %s, got %+v", tt.entry.Cid, *evt)
+				}
+
+				if evt.Type == WebhookEventKey && !slices.Equal(evt.RotationKeys, tt.entry.Operation.RotationKeys()) {
+					t.Fatalf("expected the new rotation keys, got %v", evt.RotationKeys)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expect   time.Duration
+	}{
+		{0, webhookBaseBackoff},
+		{1, webhookBaseBackoff},
+		{2, 2 * webhookBaseBackoff},
+		{4, 8 * webhookBaseBackoff},
+		{11, 1024 * webhookBaseBackoff},
+		{13, webhookMaxBackoff},
+		{1000, webhookMaxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.expect {
+			t.Fatalf("expected %s after %d attempts, got %s", tt.expect, tt.attempts, got)
+		}
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	payload := []byte(`{"type":"handle","did":"did:plc:test"}`)
+
+	// HMAC-SHA256 of `1700000000.{"type":"handle","did":"did:plc:test"}` with the key whsec_test
+	expected := "2670c065560285c6064ff6f60aeaee8bf92b4dd61f90f0cbcda9c6863f6822d3"
+	if got := signWebhookPayload("whsec_test", "1700000000", payload); got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+
+	if signWebhookPayload("whsec_test", "1700000001", payload) == expected {
+		t.Fatal("expected the timestamp to be signed")
+	}
+}